@@ -0,0 +1,76 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// RenderMany renders each of docs with the same options, running up to
+// concurrency LaTeX processes at once, or one per CPU if concurrency is 0 or
+// less. Each document gets its own temporary directory. The PDFs and errors
+// line up with docs, so pdfs[i] and errs[i] are the results of Render(docs[i],
+// options). A document that fails doesn't stop the others; its PDF is nil and
+// its error is set. Callbacks in options, such as OnRun, may be called from
+// several goroutines at once.
+func RenderMany(docs []string, options Options, concurrency int) (pdfs [][]byte, errs []error) {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	pdfs = make([][]byte, len(docs))
+	errs = make([]error, len(docs))
+	var next = make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(docs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				pdfs[i], errs[i] = Render(docs[i], options)
+			}
+		}()
+	}
+	for i := range docs {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return pdfs, errs
+}
+
+// Pool limits how many renders run at once, since each LaTeX process can use
+// a lot of memory. A Pool is safe to share between goroutines.
+type Pool struct {
+	slots chan struct{}
+}
+
+// NewPool returns a Pool that runs up to maxConcurrent renders at once, or one
+// per CPU if maxConcurrent is 0 or less.
+func NewPool(maxConcurrent int) *Pool {
+	if maxConcurrent <= 0 {
+		maxConcurrent = runtime.NumCPU()
+	}
+	return &Pool{slots: make(chan struct{}, maxConcurrent)}
+}
+
+// Render is like the package's Render, but waits for a free slot first.
+func (p *Pool) Render(document string, options Options) ([]byte, error) {
+	return p.RenderContext(context.Background(), document, options)
+}
+
+// RenderContext is like the package's RenderContext, but waits for a free slot
+// first. If ctx is done while it's waiting, it gives up without rendering.
+// Options.Timeout only starts counting once the render does.
+func (p *Pool) RenderContext(ctx context.Context, document string, options Options) ([]byte, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("gotex: render aborted: %w", ctx.Err())
+	}
+	defer func() { <-p.slots }()
+	return RenderContext(ctx, document, options)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// Cache stores rendered output so that rendering the same document with the
+// same options again can skip LaTeX entirely. Set Options.Cache to use one.
+// If renders run concurrently, the Cache must be safe for concurrent use.
+type Cache interface {
+	// Get returns the output stored under key, if there is any.
+	Get(key string) ([]byte, bool)
+	// Put stores output under key.
+	Put(key string, output []byte)
+}
+
+// LRUCache is a Cache that keeps a fixed number of outputs in memory,
+// forgetting the least recently used one to make room for a new one. It is
+// safe for concurrent use.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// lruEntry is what an LRUCache keeps in its list.
+type lruEntry struct {
+	key    string
+	output []byte
+}
+
+// NewLRUCache returns an LRUCache that holds up to size outputs.
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{size: size, order: list.New(),
+		entries: make(map[string]*list.Element)}
+}
+
+// Get returns the output stored under key, and marks it as recently used.
+func (c *LRUCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var element, ok = c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).output, true
+}
+
+// Put stores output under key, forgetting the least recently used output if
+// the cache is full.
+func (c *LRUCache) Put(key string, output []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).output = output
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, output: output})
+	for c.order.Len() > c.size {
+		var oldest = c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// cacheKey hashes the document along with every option that affects the
+// output. file is the name of the document inside the temporary directory,
+// if it isn't read from document.
+func cacheKey(document io.Reader, file string, options Options) (string, error) {
+	var h = sha256.New()
+	if document != nil {
+		if _, err := io.Copy(h, document); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(h, "\x00%q\n", file)
+	fmt.Fprintf(h, "%q %d %q %d %d\n", options.Engine, options.OutputFormat,
+		options.Command, options.Runs, options.MaxRuns)
+	fmt.Fprintf(h, "%q %q %q %q\n", options.Texinputs, options.TexinputsDirs,
+		options.FontDirs, options.RerunPatterns)
+	fmt.Fprintf(h, "%q %d %q %t %t %t\n", options.InteractionMode,
+		options.ShellEscape, options.ExtraArgs, options.FileLineError,
+		options.WriteSource, options.SyncTeX)
+	fmt.Fprintf(h, "%q %q %q %t %q %q\n", options.Jobname, options.BibEngine,
+		options.BibCommand, options.MakeIndex, options.MakeIndexCommand,
+		options.MakeIndexArgs)
+	fmt.Fprintf(h, "%t %q %t %q\n", options.Glossaries, options.GlossariesCommand,
+		options.Latexmk, options.LatexmkCommand)
+	fmt.Fprintf(h, "%q %t %d %d %q %d %q\n", options.GhostscriptCommand,
+		options.Optimize, options.OptimizeDPI, options.PDFA, options.PDFAProfile,
+		options.InfoDate.UnixNano(), options.InfoProducer)
+	fmt.Fprintf(h, "%q %t %t %q\n", options.DvipsCommand, options.ClearEnv,
+		options.Reproducible, options.FailOnWarnings)
+	var env = make(map[string][]byte, len(options.Env))
+	for key, value := range options.Env {
+		env[key] = []byte(value)
+	}
+	hashMap(h, env)
+	var files = make(map[string][]byte, len(options.Files))
+	for name, contents := range options.Files {
+		files[name] = contents
+	}
+	if options.FS != nil {
+		var err = fs.WalkDir(options.FS, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return err
+			}
+			contents, err := fs.ReadFile(options.FS, name)
+			files["\x00fs/"+name] = contents
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	for name, contents := range options.Aux {
+		files["\x00aux/"+name] = contents
+	}
+	hashMap(h, files)
+	h.Write(options.Format)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashMap writes m to h in a fixed order.
+func hashMap(h io.Writer, m map[string][]byte) {
+	var keys = make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%q=%q\n", key, m[key])
+	}
+}
+
+// renderCached delivers output from the cache as if it had just been
+// rendered.
+func renderCached(ctx context.Context, options Options, output []byte, deliver deliverFunc) (RenderResult, error) {
+	var result = RenderResult{Cached: true, Converged: true}
+	var dir, err = makeTempDir(options.TempDir)
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(dir)
+	var name = path.Join(dir, options.Jobname+options.OutputFormat.ext())
+	if err := ioutil.WriteFile(name, output, 0644); err != nil {
+		return result, err
+	}
+	return result, deliver(ctx, options, name)
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	var cache = NewLRUCache(2)
+	cache.Put("a", []byte("A"))
+	cache.Put("b", []byte("B"))
+	// Using a makes b the oldest, so it goes first.
+	if output, ok := cache.Get("a"); !ok || string(output) != "A" {
+		t.Errorf("Should find a, got %q, %v", output, ok)
+	}
+	cache.Put("c", []byte("C"))
+	if _, ok := cache.Get("b"); ok {
+		t.Error("Should forget the least recently used output")
+	}
+	cache.Put("a", []byte("A2"))
+	for key, want := range map[string]string{"a": "A2", "c": "C"} {
+		if output, ok := cache.Get(key); !ok || string(output) != want {
+			t.Errorf("Should find %s, got %q, %v", key, output, ok)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RenderImage renders the document to PDF and rasterizes it to PNG at the
+// given resolution in dots per inch, for things like preview thumbnails. It
+// returns one image per page, in page order. The rasterizer is chosen by
+// Options.Rasterizer.
+func RenderImage(document string, options Options, dpi int) ([][]byte, error) {
+	if dpi <= 0 {
+		return nil, fmt.Errorf("gotex: invalid DPI %d", dpi)
+	}
+	var command, err = rasterCommand(options)
+	if err != nil {
+		return nil, err
+	}
+	// Don't render anything only to find out it can't be rasterized.
+	if _, err = exec.LookPath(command); err != nil {
+		if err = commandNotFound(err); errors.Is(err, ErrCommandNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("gotex: can't run %s: %w", command, err)
+	}
+
+	options.OutputFormat = PDF
+	var pages [][]byte
+	_, err = render(context.Background(), strings.NewReader(document), options,
+		func(ctx context.Context, options Options, name string) error {
+			var dir = filepath.Dir(name)
+			var args = rasterArgs(options, dpi, filepath.Base(name))
+			var err = runTool(ctx, options, dir, "", command, args...)
+			if err != nil {
+				return err
+			}
+			pages, err = readPages(dir, "page-", ".png")
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// rasterCommand returns the executable for Options.Rasterizer.
+func rasterCommand(options Options) (string, error) {
+	switch options.Rasterizer {
+	case "", "pdftoppm":
+		if options.PdftoppmCommand != "" {
+			return options.PdftoppmCommand, nil
+		}
+		return "pdftoppm", nil
+	case "ghostscript":
+		if options.GhostscriptCommand != "" {
+			return options.GhostscriptCommand, nil
+		}
+		return "gs", nil
+	}
+	return "", fmt.Errorf("gotex: unknown Rasterizer %q", options.Rasterizer)
+}
+
+// rasterArgs returns the arguments that make Options.Rasterizer turn the PDF
+// named input into PNG images named like "page-1.png".
+func rasterArgs(options Options, dpi int, input string) []string {
+	var resolution = strconv.Itoa(dpi)
+	if options.Rasterizer == "ghostscript" {
+		return []string{"-dSAFER", "-dBATCH", "-dNOPAUSE", "-q",
+			"-sDEVICE=png16m", "-r" + resolution, "-sOutputFile=page-%d.png",
+			input}
+	}
+	// pdftoppm names the pages like "page-01.png", padding as needed.
+	return []string{"-png", "-r", resolution, input, "page"}
+}
+
+// RenderSVG renders the document to DVI and converts it to SVG with dvisvgm,
+// for embedding in web pages. It returns one SVG image per page, in page
+// order. Options.OutputFormat is ignored; the DVI is made with the default
+// command for Options.Engine, which must not be XeLaTeX.
+func RenderSVG(document string, options Options) ([][]byte, error) {
+	options.OutputFormat = DVI
+	var pages [][]byte
+	var _, err = render(context.Background(), strings.NewReader(document), options,
+		func(ctx context.Context, options Options, name string) error {
+			var err error
+			pages, err = dvisvgm(ctx, options, name)
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// dvisvgm converts every page of the named DVI file to SVG and returns them.
+func dvisvgm(ctx context.Context, options Options, name string) ([][]byte, error) {
+	var command = options.DvisvgmCommand
+	if command == "" {
+		command = "dvisvgm"
+	}
+	var dir = filepath.Dir(name)
+	var base = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	// Write each page to a file named after its page number, like
+	// "gotex-page-3.svg".
+	var args = append([]string{"--page=1-", "--output=%f-page-%p.svg"},
+		options.DvisvgmArgs...)
+	args = append(args, filepath.Base(name))
+	var err = runTool(ctx, options, dir, "", command, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return readPages(dir, base+"-page-", ".svg")
+}
+
+// readPages reads the files in dir named prefix, a page number, and ext,
+// returning them in page order. Any leading zeros in the number are fine.
+func readPages(dir, prefix, ext string) ([][]byte, error) {
+	var files, _ = filepath.Glob(filepath.Join(dir, prefix+"*"+ext))
+	if len(files) == 0 {
+		return nil, fmt.Errorf("gotex: no %s files were produced", ext)
+	}
+	// Sort by page number; the names don't sort correctly as strings.
+	var page = func(file string) int {
+		var n, _ = strconv.Atoi(strings.TrimSuffix(
+			strings.TrimPrefix(filepath.Base(file), prefix), ext))
+		return n
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return page(files[i]) < page(files[j])
+	})
+	var pages = make([][]byte, len(files))
+	for i, file := range files {
+		var err error
+		pages[i], err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Engine is a TeX engine, which determines the default Command along with
+// OutputFormat.
+type Engine string
+
+// The supported engines.
+const (
+	// PdfLaTeX is pdfTeX with LaTeX, the traditional default.
+	PdfLaTeX Engine = "pdflatex"
+	// XeLaTeX is XeTeX with LaTeX, which can use system OpenType fonts
+	// through fontspec. It writes an .xdv file and converts it to PDF with
+	// xdvipdfmx as it goes, so the result is still a PDF.
+	XeLaTeX Engine = "xelatex"
+	// LuaLaTeX is LuaTeX with LaTeX, needed for packages written in Lua.
+	LuaLaTeX Engine = "lualatex"
+	// LaTeX is pdfTeX with LaTeX in DVI mode, as the latex command. It is
+	// the same command PdfLaTeX uses for DVI and PS, but it can't produce a
+	// PDF, so OutputFormat has to be set to one of those.
+	LaTeX Engine = "latex"
+)
+
+// known reports whether gotex knows how to drive the engine.
+func (e Engine) known() bool {
+	switch e {
+	case PdfLaTeX, XeLaTeX, LuaLaTeX, LaTeX:
+		return true
+	}
+	return false
+}
+
+// OutputFormat is the kind of file a render produces.
+type OutputFormat int
+
+// The supported output formats.
+const (
+	// PDF is the default.
+	PDF OutputFormat = iota
+	// DVI is the traditional TeX output, for further processing with tools
+	// like dvips or dvisvgm. It is produced with latex rather than pdflatex,
+	// or dvilualatex for LuaLaTeX. XeLaTeX can't produce it.
+	DVI
+	// XDV is XeLaTeX's extended DVI, which it normally converts to PDF
+	// itself. It is produced by running xelatex with -no-pdf, so only XeLaTeX
+	// can produce it.
+	XDV
+	// PS is PostScript, produced by running dvips on the DVI output. As with
+	// DVI, XeLaTeX can't produce it.
+	PS
+)
+
+// String returns the name of the format, like "PDF".
+func (f OutputFormat) String() string {
+	switch f {
+	case PDF:
+		return "PDF"
+	case DVI:
+		return "DVI"
+	case XDV:
+		return "XDV"
+	case PS:
+		return "PS"
+	}
+	return "OutputFormat(" + strconv.Itoa(int(f)) + ")"
+}
+
+// ext returns the extension of the output file, including the dot.
+func (f OutputFormat) ext() string {
+	switch f {
+	case DVI:
+		return ".dvi"
+	case XDV:
+		return ".xdv"
+	case PS:
+		return ".ps"
+	}
+	return ".pdf"
+}
+
+// contentType returns the MIME type of the format.
+func (f OutputFormat) contentType() string {
+	switch f {
+	case PDF:
+		return "application/pdf"
+	case DVI:
+		return "application/x-dvi"
+	case PS:
+		return "application/postscript"
+	}
+	return "application/octet-stream"
+}
+
+// command returns the default program that runs the engine to produce the
+// given output format.
+func (e Engine) command(format OutputFormat) (string, error) {
+	switch format {
+	case PDF:
+		if e != LaTeX {
+			return string(e), nil
+		}
+	case DVI, PS:
+		switch e {
+		case PdfLaTeX, LaTeX:
+			return "latex", nil
+		case LuaLaTeX:
+			return "dvilualatex", nil
+		}
+	case XDV:
+		if e == XeLaTeX {
+			return string(e), nil
+		}
+	default:
+		return "", fmt.Errorf("gotex: unknown %v", format)
+	}
+	return "", fmt.Errorf("gotex: %s can't produce %v output", e, format)
+}
+
+// latexmk returns the arguments that have latexmk run command, the engine e,
+// to produce the given output format. The format has already been checked.
+func (e Engine) latexmk(format OutputFormat, command string) []string {
+	var run = command + " %O %S"
+	switch {
+	case format == XDV:
+		return []string{"-xdv", "-xelatex=" + run}
+	case format == PDF && e == XeLaTeX:
+		return []string{"-pdfxe", "-xelatex=" + run}
+	case format == PDF && e == LuaLaTeX:
+		return []string{"-pdflua", "-lualatex=" + run}
+	case format == PDF:
+		return []string{"-pdf", "-pdflatex=" + run}
+	}
+	var args = []string{"-dvi", "-latex=" + run}
+	if e == LuaLaTeX {
+		args = []string{"-dvilua", "-dvilualatex=" + run}
+	}
+	if format == PS {
+		args = append(args, "-ps")
+	}
+	return args
+}
+
+// ShellEscapeMode controls whether the document may run external commands
+// through \write18.
+type ShellEscapeMode int
+
+// The shell escape modes.
+const (
+	// ShellEscapeDisabled passes -no-shell-escape, so the document can't run
+	// anything even if the TeX installation's configuration would allow it.
+	ShellEscapeDisabled ShellEscapeMode = iota
+	// ShellEscapeRestricted passes -shell-restricted, which only allows the
+	// commands listed in shell_escape_commands in texmf.cnf.
+	ShellEscapeRestricted
+	// ShellEscapeEnabled passes -shell-escape, which lets the document run
+	// any command at all with the privileges of your process.
+	ShellEscapeEnabled
+)
+
+// arg returns the LaTeX flag for the mode.
+func (m ShellEscapeMode) arg() string {
+	switch m {
+	case ShellEscapeRestricted:
+		return "-shell-restricted"
+	case ShellEscapeEnabled:
+		return "-shell-escape"
+	}
+	return "-no-shell-escape"
+}
+
+// Version runs the LaTeX command that options would use with --version and
+// returns the first line it prints, like "pdfTeX 3.141592653-2.6-1.40.25 (TeX
+// Live 2023)". It is handy for support diagnostics and for checking that
+// LaTeX is installed at all.
+func Version(options Options) (string, error) {
+	options, err := setDefaults(options)
+	if err != nil {
+		return "", err
+	}
+	var cmd = newCommand(context.Background(), options, "", options.Command, "--version")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("gotex: can't get the LaTeX version: %w", commandNotFound(err))
+	}
+	var line, _, _ = strings.Cut(output.String(), "\n")
+	return strings.TrimSpace(line), nil
+}
+
+// Check makes sure that the programs options call for are installed, without
+// rendering anything: the LaTeX command, plus latexmk, dvips, makeindex,
+// makeglossaries, Ghostscript, or the bibliography tool if they're sure to be
+// needed. If one is missing, the error wraps ErrCommandNotFound.
+func Check(options Options) error {
+	options, err := setDefaults(options)
+	if err != nil {
+		return err
+	}
+	var commands = []string{options.Command}
+	if options.Latexmk {
+		commands = append(commands, options.LatexmkCommand)
+	}
+	if options.OutputFormat == PS {
+		commands = append(commands, options.DvipsCommand)
+	}
+	if options.MakeIndex {
+		commands = append(commands, options.MakeIndexCommand)
+	}
+	if options.Glossaries {
+		commands = append(commands, options.GlossariesCommand)
+	}
+	if options.Optimize || options.PDFA > 0 {
+		commands = append(commands, options.GhostscriptCommand)
+	}
+	if options.BibCommand != "" {
+		commands = append(commands, options.BibCommand)
+	} else if options.BibEngine == "bibtex" || options.BibEngine == "biber" {
+		commands = append(commands, options.BibEngine)
+	}
+	for _, command := range commands {
+		if _, err := exec.LookPath(command); err != nil {
+			if err = commandNotFound(err); errors.Is(err, ErrCommandNotFound) {
+				return err
+			}
+			return fmt.Errorf("gotex: can't run %s: %w", command, err)
+		}
+	}
+	return nil
+}
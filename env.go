@@ -0,0 +1,115 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// environ returns the environment for the LaTeX process and other tools. A nil
+// return means the parent's environment is inherited unchanged.
+func environ(options Options) []string {
+	var env []string
+	if options.ClearEnv {
+		env = []string{}
+	} else if len(options.Env) > 0 || options.Texinputs != "" ||
+		len(options.TexinputsDirs) > 0 || len(options.FontDirs) > 0 ||
+		options.Reproducible {
+		env = os.Environ()
+	} else {
+		return nil
+	}
+
+	// Go through Env in a fixed order so the result is the same every time.
+	var keys = make([]string, 0, len(options.Env))
+	for key := range options.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = setenv(env, key, options.Env[key])
+	}
+
+	// FORCE_SOURCE_DATE makes the date in the document, like \today, come
+	// from SOURCE_DATE_EPOCH too, not just the PDF's timestamps.
+	if options.Reproducible {
+		if _, ok := options.Env["SOURCE_DATE_EPOCH"]; !ok {
+			env = setenv(env, "SOURCE_DATE_EPOCH", "0")
+		}
+		env = setenv(env, "FORCE_SOURCE_DATE", "1")
+	}
+
+	// Set $TEXINPUTS if requested. The trailing separator means that LaTeX
+	// should include the normal asset directories as well.
+	// A TEXINPUTS from Env is searched after the ones from Texinputs and
+	// TexinputsDirs, rather than being replaced by them.
+	var texinputs []string
+	if options.Texinputs != "" {
+		texinputs = append(texinputs, options.Texinputs)
+	}
+	texinputs = append(texinputs, options.TexinputsDirs...)
+	env = prependPath(env, options, "TEXINPUTS", texinputs, true)
+
+	// The default font paths already include $OSFONTDIR, so that's enough
+	// for most installations. It has no default of its own, and an empty
+	// entry in it would have kpathsea search the whole filesystem, so it
+	// doesn't get a trailing separator.
+	env = prependPath(env, options, "OSFONTDIR", options.FontDirs, false)
+	env = prependPath(env, options, "OPENTYPEFONTS", options.FontDirs, true)
+	env = prependPath(env, options, "TTFONTS", options.FontDirs, true)
+	return env
+}
+
+// prependPath sets the search path key in env to dirs, followed by the value
+// of key from options.Env, if any. With defaults, it ends in a separator so
+// the usual path is searched too. It does nothing if dirs is empty.
+func prependPath(env []string, options Options, key string, dirs []string, defaults bool) []string {
+	if len(dirs) == 0 {
+		return env
+	}
+	var sep = string(os.PathListSeparator)
+	if extra := strings.TrimSuffix(options.Env[key], sep); extra != "" {
+		// Don't write into the caller's slice.
+		dirs = append(dirs[:len(dirs):len(dirs)], extra)
+	}
+	var value = strings.Join(dirs, sep)
+	if defaults {
+		value += sep
+	}
+	return setenv(env, key, value)
+}
+
+// setenv sets key to value in env, replacing any existing value.
+func setenv(env []string, key, value string) []string {
+	var prefix = key + "="
+	for i, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[i] = prefix + value
+			return env
+		}
+	}
+	return append(env, prefix+value)
+}
+
+// searchFirst returns a copy of options.Env with dir at the front of the
+// search path in key, falling back to the inherited environment and then to
+// the default path.
+func searchFirst(options Options, key, dir string) map[string]string {
+	var env = make(map[string]string, len(options.Env)+1)
+	for k, v := range options.Env {
+		env[k] = v
+	}
+	var sep = string(os.PathListSeparator)
+	var rest, ok = options.Env[key]
+	if !ok && !options.ClearEnv {
+		rest = os.Getenv(key)
+	}
+	env[key] = dir + sep + rest
+	if rest == "" {
+		env[key] = dir + sep
+	}
+	return env
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// ErrTimeout is returned when a render takes longer than Options.Timeout.
+var ErrTimeout = errors.New("gotex: render timed out")
+
+// ErrCommandNotFound is returned, wrapped, when LaTeX or one of the other
+// programs gotex runs isn't installed, either because a bare name isn't on
+// $PATH or because a path doesn't exist. It means gotex is misconfigured, not
+// that the document is broken, so there's no log to look at.
+var ErrCommandNotFound = errors.New("gotex: command not found")
+
+// exitCode returns the exit status from the error of running a command, or -1
+// if it didn't exit normally.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// commandNotFound wraps err in ErrCommandNotFound if it says the command
+// doesn't exist. Otherwise, it returns err unchanged.
+func commandNotFound(err error) error {
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %w", ErrCommandNotFound, err)
+	}
+	return err
+}
+
+// logTailLines is how many lines from the end of the log a LatexError keeps.
+const logTailLines = 40
+
+// errorTailLines and errorTailBytes limit how much of the log goes in a
+// LatexError's message.
+const (
+	errorTailLines = 20
+	errorTailBytes = 2000
+)
+
+// LatexError is returned when LaTeX fails to compile the document. Use
+// errors.As to get at the details.
+type LatexError struct {
+	// Dir is the temporary directory that was left behind for postmortem.
+	Dir string
+	// LogFile is the path to the LaTeX log file inside Dir.
+	LogFile string
+	// Message is the first error LaTeX reported, without the leading "! ".
+	// It is empty if no error line could be found in the log.
+	Message string
+	// Errors are the errors LaTeX reported in the log, in order. When it
+	// halts on the first error, there's usually just that one, possibly
+	// followed by an "Emergency stop." With an InteractionMode such as
+	// nonstopmode, LaTeX carries on past errors, so there can be many; only
+	// the first 100 are kept.
+	Errors []LatexErrorEntry
+	// Log is the whole log file.
+	Log []byte
+	// Tail is the end of the log file, which usually shows what went wrong.
+	Tail string
+	// Stdout and Stderr are the raw output of the failed LaTeX run, up to
+	// the last 64 KiB of each. Some errors, such as those from shell escape
+	// commands or crashes, only show up here.
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is LaTeX's exit status, or -1 if it didn't exit normally, such
+	// as when it was killed by a signal.
+	ExitCode int
+	// Err is the error from running LaTeX, usually an *exec.ExitError.
+	Err error
+}
+
+// LatexErrorEntry is one error from a LaTeX log, which looks like:
+//
+//	! Undefined control sequence.
+//	l.42 \foo
+//	          bar
+//
+// With Options.FileLineError, the first line is like
+// "./gotex.tex:42: Undefined control sequence." instead.
+type LatexErrorEntry struct {
+	// Message is the error, without the leading "! " or file and line.
+	Message string
+	// File is the file the error is in. It's only known with
+	// Options.FileLineError.
+	File string
+	// Line is the line of the document LaTeX was on, or 0 if it didn't say.
+	Line int
+	// Context is what the log shows after the message, up to and including
+	// the line after the "l.42" line. The line break between those two lines
+	// marks exactly where in the document LaTeX was.
+	Context string
+}
+
+// Error tells you where to find the log, and what the first error was if it
+// could be found. Since the log doesn't record everything, it also includes
+// the last thing LaTeX printed to stderr. The end of the log follows on the
+// next lines, since that's often enough to see what went wrong.
+func (e *LatexError) Error() string {
+	var msg = "LaTeX error"
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if line := lastLine(e.Stderr); line != "" {
+		msg += " (stderr: " + line + ")"
+	}
+	msg += ". Check " + e.LogFile
+	var lines = strings.Split(e.Tail, "\n")
+	if len(lines) > errorTailLines {
+		lines = lines[len(lines)-errorTailLines:]
+	}
+	var tail = strings.Join(lines, "\n")
+	if len(tail) > errorTailBytes {
+		tail = "..." + tail[len(tail)-errorTailBytes:]
+	}
+	if strings.TrimSpace(tail) != "" {
+		msg += ":\n" + tail
+	}
+	return msg
+}
+
+// lastLine returns the last line of b that isn't blank.
+func lastLine(b []byte) string {
+	var lines = strings.Split(strings.TrimSpace(string(b)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Unwrap returns the error from running LaTeX.
+func (e *LatexError) Unwrap() error {
+	return e.Err
+}
+
+// newLatexError builds a LatexError from the log file in dir.
+func newLatexError(dir, logFile string) *LatexError {
+	var log = readLog(logFile)
+	var e = &LatexError{Dir: dir, LogFile: logFile, Log: log, Errors: logErrors(log)}
+	if len(e.Errors) > 0 {
+		e.Message = e.Errors[0].Message
+	}
+	var lines []string
+	var scanner = bufio.NewScanner(bytes.NewReader(log))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > logTailLines {
+			lines = lines[1:]
+		}
+	}
+	e.Tail = strings.Join(lines, "\n")
+	return e
+}
+
+// WarningError is returned when the log has warnings of a kind listed in
+// Options.FailOnWarnings. Other than that, the render succeeded: RenderFull
+// returns the PDF along with the error, and RenderTo and RenderToFile have
+// already written the output.
+type WarningError struct {
+	// Warnings are the warnings that caused the failure.
+	Warnings []Warning
+}
+
+// Error lists the warnings.
+func (e *WarningError) Error() string {
+	var messages = make([]string, len(e.Warnings))
+	for i, warning := range e.Warnings {
+		messages[i] = warning.Message
+	}
+	return fmt.Sprintf("gotex: %d fatal warnings: %s", len(e.Warnings),
+		strings.Join(messages, "; "))
+}
+
+// DryRunError is returned instead of running LaTeX when Options.DryRun is
+// set. It describes the command exactly as gotex would run it.
+type DryRunError struct {
+	// Args is the command line, starting with the command itself.
+	Args []string
+	// Dir is the directory the command would run in.
+	Dir string
+	// Env is the command's whole environment, or nil if it would inherit
+	// gotex's unchanged.
+	Env []string
+}
+
+// Error shows the command line the way a shell would take it.
+func (e *DryRunError) Error() string {
+	var args = make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = shellQuote(arg)
+	}
+	return "gotex: dry run: cd " + shellQuote(e.Dir) + " && " + strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell, if it needs it.
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`&;|<>()*?[]{}!~#%") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ToolError is returned when a helper program, such as BibTeX, fails. Like a
+// LatexError, the temporary directory is left behind for postmortem.
+type ToolError struct {
+	// Tool is the command that failed.
+	Tool string
+	// Dir is the temporary directory that was left behind.
+	Dir string
+	// LogFile is the path to the tool's own log file, if it writes one. It
+	// is kept separate from the LaTeX log.
+	LogFile string
+	// Log is the contents of LogFile.
+	Log []byte
+	// ExitCode is the tool's exit status, or -1 if it didn't run or was
+	// killed.
+	ExitCode int
+	// Output is everything the tool wrote to stdout and stderr.
+	Output []byte
+	// Err is the underlying error from running the tool.
+	Err error
+}
+
+// Error says which tool failed and where to look.
+func (e *ToolError) Error() string {
+	var where = e.Dir
+	if e.LogFile != "" {
+		where = e.LogFile
+	}
+	return e.Tool + " error: " + e.Err.Error() + ". Check " + where
+}
+
+// Unwrap returns the underlying error.
+func (e *ToolError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"strings"
+)
+
+// escaper replaces each of LaTeX's special characters with a command that
+// prints it. It works in a single pass, so the replacements aren't escaped
+// again.
+var escaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`~`, `\textasciitilde{}`,
+	`^`, `\textasciicircum{}`,
+)
+
+// EscapeString makes s safe to put in a LaTeX document as text, by replacing
+// the characters LaTeX treats specially: \ & % $ # _ { } ~ ^. Use it on
+// anything from outside, such as user input or database fields, before
+// putting it in a document.
+func EscapeString(s string) string {
+	return escaper.Replace(s)
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"testing"
+)
+
+func TestEscapeString(t *testing.T) {
+	var tests = map[string]string{
+		"":                  "",
+		"plain text":        "plain text",
+		`\`:                 `\textbackslash{}`,
+		"&":                 `\&`,
+		"%":                 `\%`,
+		"$":                 `\$`,
+		"#":                 `\#`,
+		"_":                 `\_`,
+		"{":                 `\{`,
+		"}":                 `\}`,
+		"~":                 `\textasciitilde{}`,
+		"^":                 `\textasciicircum{}`,
+		`\textbf{x}`:        `\textbackslash{}textbf\{x\}`,
+		"50% off & $5_a #1": `50\% off \& \$5\_a \#1`,
+		"~user/^caret^":     `\textasciitilde{}user/\textasciicircum{}caret\textasciicircum{}`,
+		"café, naïve":       "café, naïve",
+		`\\{}`:              `\textbackslash{}\textbackslash{}\{\}`,
+	}
+	for s, want := range tests {
+		if got := EscapeString(s); got != want {
+			t.Errorf("EscapeString(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeFiles writes each of files into dir, refusing to write anywhere else.
+func writeFiles(dir string, files map[string][]byte) error {
+	for name, contents := range files {
+		var clean, err = cleanFilename(name)
+		if err != nil {
+			return err
+		}
+		var file = filepath.Join(dir, clean)
+		err = os.MkdirAll(filepath.Dir(file), 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(file, contents, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanFilename converts a slash-separated relative name to a local path,
+// rejecting names that would point outside the directory they're joined to.
+func cleanFilename(name string) (string, error) {
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(name) ||
+		filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("gotex: invalid filename %q", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("gotex: invalid filename %q", name)
+		}
+	}
+	return filepath.FromSlash(path.Clean(name)), nil
+}
+
+// copyFS recreates the regular files and directories of fsys inside dir. A nil
+// fsys is fine and copies nothing.
+func copyFS(dir string, fsys fs.FS) error {
+	if fsys == nil {
+		return nil
+	}
+	return fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var file = filepath.Join(dir, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(file, 0700)
+		}
+		// Don't follow symlinks, which could point anywhere.
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		contents, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(file, contents, 0600)
+	})
+}
+
+// copyTo returns a deliverFunc that copies the output file to w.
+func copyTo(w io.Writer) deliverFunc {
+	return func(ctx context.Context, options Options, name string) error {
+		return copyFile(w, name)
+	}
+}
+
+// copyFile copies the contents of the named file to w.
+func copyFile(w io.Writer, name string) error {
+	var file, err = os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// moveFile moves the file at from to to, creating to's parent directories.
+// If a rename isn't possible because they're on different filesystems, the
+// file is copied next to to first and renamed from there, so to only ever
+// appears complete.
+func moveFile(from, to string) error {
+	var err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	if os.Rename(from, to) == nil {
+		return nil
+	}
+
+	var temp *os.File
+	temp, err = ioutil.TempFile(filepath.Dir(to), "."+filepath.Base(to)+"-")
+	if err != nil {
+		return err
+	}
+	err = copyFile(temp, from)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// TempFile is only readable by us, but the output should get the
+		// usual permissions.
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), to)
+	}
+	if err != nil {
+		_ = os.Remove(temp.Name())
+	}
+	return err
+}
+
+// writeSource writes the document from src into dir as name, and returns a
+// source that has LaTeX compile it from there.
+func writeSource(dir, name string, src *source) (*source, error) {
+	var document, err = src.next()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, document)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &source{file: name}, nil
+}
+
+// countingWriter counts the bytes written through it to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	var n, err = c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readAux reads the files LaTeX and the tools it ran left in dir for the
+// jobname, leaving out the output, the log, and the source, which the caller
+// already has.
+func readAux(options Options, dir string) (map[string][]byte, error) {
+	var entries, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var skip = map[string]bool{
+		options.Jobname + options.OutputFormat.ext(): true,
+		options.Jobname + ".log":                     true,
+		options.Jobname + ".tex":                     true,
+	}
+	var aux = make(map[string][]byte)
+	for _, entry := range entries {
+		var name = entry.Name()
+		if !entry.Mode().IsRegular() || skip[name] ||
+			!strings.HasPrefix(name, options.Jobname+".") {
+			continue
+		}
+		aux[name], err = ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return aux, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// formatName is what Options.Format is called in the temporary directory.
+const formatName = "gotex-format"
+
+// CompileFormat dumps preamble into a format file, which can be given to later
+// renders as Options.Format so LaTeX doesn't have to process the preamble
+// again each time. For documents with a big preamble, that's often more than
+// half the work. It uses the mylatexformat package, which has to be installed.
+//
+// The preamble is everything up to \begin{document}, or up to \endofdump if
+// some of it can't go in a format. Documents rendered with the format should
+// still start with the same preamble, which mylatexformat skips over. A format
+// only works with the engine and TeX installation that made it, so options
+// should match the ones used to render. Timeout, KeepTemp, and CleanOnError
+// apply as they do to Render.
+func CompileFormat(preamble string, options Options) ([]byte, error) {
+	return CompileFormatContext(context.Background(), preamble, options)
+}
+
+// CompileFormatContext is like CompileFormat, but LaTeX is killed if ctx is
+// done before the format is, as with RenderContext.
+func CompileFormatContext(ctx context.Context, preamble string, options Options) ([]byte, error) {
+	var format, dir, err = compileFormat(ctx, preamble, options)
+	if err != nil && options.CleanOnError && !options.KeepTemp && dir != "" {
+		_ = os.RemoveAll(dir)
+	}
+	return format, err
+}
+
+// compileFormat does the work of CompileFormatContext. On failure, it returns
+// the temporary directory if it's still there.
+func compileFormat(ctx context.Context, preamble string, options Options) ([]byte, string, error) {
+	options, err := setDefaults(options)
+	if err != nil {
+		return nil, "", err
+	}
+	var parent = ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, "", fmt.Errorf("gotex: format aborted: %w", err)
+	}
+	// The format is built on top of the engine's usual one, such as
+	// pdflatex.fmt.
+	base, err := options.Engine.command(options.OutputFormat)
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err := makeTempDir(options.TempDir)
+	if err != nil {
+		return nil, "", err
+	}
+	err = copyFS(dir, options.FS)
+	if err == nil {
+		err = writeFiles(dir, options.Files)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(path.Join(dir, "preamble.tex"), []byte(preamble), 0644)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, "", err
+	}
+
+	var args = []string{"-ini", "-jobname=" + formatName,
+		"-interaction=nonstopmode", "-halt-on-error", options.ShellEscape.arg()}
+	args = append(args, options.ExtraArgs...)
+	args = append(args, "&"+base, "mylatexformat.ltx", "preamble.tex")
+	var cmd = newCommand(ctx, options, dir, options.Command, args...)
+	var stdout = &tailBuffer{max: maxOutput}
+	var stderr = &tailBuffer{max: maxOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	var logFile = path.Join(dir, formatName+".log")
+	if err := cmd.Run(); err != nil {
+		if err = commandNotFound(err); errors.Is(err, ErrCommandNotFound) {
+			_ = os.RemoveAll(dir)
+			return nil, "", err
+		}
+		var result = RenderResult{Dir: dir}
+		if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+			return nil, result.Dir, err
+		}
+		var latexErr = newLatexError(dir, logFile)
+		latexErr.Stdout, latexErr.Stderr = stdout.Bytes(), stderr.Bytes()
+		latexErr.ExitCode = exitCode(err)
+		latexErr.Err = err
+		return nil, dir, latexErr
+	}
+
+	format, err := ioutil.ReadFile(path.Join(dir, formatName+".fmt"))
+	if !options.KeepTemp {
+		_ = os.RemoveAll(dir)
+		dir = ""
+	}
+	if err != nil {
+		return nil, dir, err
+	}
+	return format, "", nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Handler returns an http.Handler that renders the body of each POST request
+// and responds with the output. If the document is at fault, it responds with
+// 422 Unprocessable Entity and the LaTeX log, or the tool's log for a
+// ToolError, as plain text; the same goes for warnings in
+// Options.FailOnWarnings, with the warnings instead of a log. A render that
+// runs past Options.Timeout is a 504, and any other failure, including a
+// LaTeX or tool binary that isn't installed, is a 500. The render is tied to
+// the request's context, so it is stopped if the client goes away. Since the
+// response is all the client gets, the temporary directory is always removed,
+// as with Options.CleanOnError.
+//
+// Handler doesn't limit the size of the request. Wrap it in
+// http.MaxBytesHandler, and set Options.Timeout, before exposing it to anyone
+// you don't trust; and leave ShellEscape disabled.
+func Handler(options Options) http.Handler {
+	options.CleanOnError = true
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "gotex: POST a document to render", http.StatusMethodNotAllowed)
+			return
+		}
+		var document, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		output, err := RenderContext(r.Context(), string(document), options)
+		if r.Context().Err() != nil {
+			// Nobody is listening.
+			return
+		}
+		var latexErr *LatexError
+		var toolErr *ToolError
+		var warningErr *WarningError
+		switch {
+		case errors.Is(err, ErrCommandNotFound):
+			// The server is missing something, not the document.
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		case errors.As(err, &latexErr):
+			writeLog(w, latexErr.Log, latexErr.Error())
+			return
+		case errors.As(err, &toolErr):
+			writeLog(w, toolErr.Log, toolErr.Error())
+			return
+		case errors.As(err, &warningErr):
+			writeLog(w, nil, warningErr.Error())
+			return
+		case errors.Is(err, ErrTimeout):
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", options.OutputFormat.contentType())
+		w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+		_, _ = w.Write(output)
+	})
+}
+
+// writeLog responds with a 422 and log, or message if there's no log.
+func writeLog(w http.ResponseWriter, log []byte, message string) {
+	if len(log) == 0 {
+		log = []byte(message + "\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_, _ = w.Write(log)
+}
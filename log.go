@@ -0,0 +1,271 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WarningKind says what sort of problem a Warning is about.
+type WarningKind string
+
+// The warnings gotex recognizes in the log.
+const (
+	UndefinedReference WarningKind = "undefined reference"
+	UndefinedCitation  WarningKind = "undefined citation"
+	OverfullBox        WarningKind = "overfull box"
+	UnderfullBox       WarningKind = "underfull box"
+	MissingCharacter   WarningKind = "missing character"
+	UndefinedFontShape WarningKind = "undefined font shape"
+)
+
+// Warning is a problem LaTeX reported that didn't stop it from producing
+// output.
+type Warning struct {
+	Kind WarningKind
+	// Message is the warning as it appears in the log, with wrapped lines
+	// joined back together.
+	Message string
+	// Line is the line of the document the warning is about, or 0 if the log
+	// doesn't say. For a box spanning several lines, it's the first.
+	Line int
+}
+
+// logLineWidth is the width TeX wraps log lines at, unless max_print_line has
+// been changed.
+const logLineWidth = 79
+
+var (
+	// Like "LaTeX Warning: Reference `fig:1' on page 2 undefined on input
+	// line 34."
+	undefinedReference = regexp.MustCompile("^LaTeX Warning: Reference `[^']*' on page \\d+ undefined")
+	// Like "Package natbib Warning: Citation `knuth' on page 2 undefined on
+	// input line 34."
+	undefinedCitation = regexp.MustCompile("^(LaTeX|Package natbib) Warning: Citation `[^']*' on page \\d+ undefined")
+	// Like "Overfull \hbox (1.2pt too wide) in paragraph at lines 12--15".
+	overfullBox  = regexp.MustCompile(`^Overfull \\[hv]box`)
+	underfullBox = regexp.MustCompile(`^Underfull \\[hv]box`)
+	// Like "LaTeX Font Warning: Font shape `OT1/cmr/bx/it' undefined".
+	undefinedFontShape = regexp.MustCompile("^LaTeX Font Warning: Font shape `[^']*' undefined")
+	// Like "(Font)              using `OT1/cmr/bx/n' instead on input line 5."
+	continuation = regexp.MustCompile(`^\([A-Za-z]+\) +(.*)$`)
+	// Where in the document a warning is.
+	warningLine = regexp.MustCompile(`(?:on input line|at lines?) (\d+)`)
+)
+
+// outputWritten matches the line at the end of a successful run, like:
+// "Output written on gotex.pdf (12 pages, 34567 bytes)."
+// TeX wraps long log lines, so the file name may be split across lines.
+var outputWritten = regexp.MustCompile(`Output written on [^(]*\((\d+)\s+pages?`)
+
+// logPages returns the number of pages LaTeX says it wrote. It returns 0 if
+// the log reports "No pages of output." or doesn't say.
+func logPages(log []byte) int {
+	var matches = outputWritten.FindAllSubmatch(log, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+	var pages, err = strconv.Atoi(string(matches[len(matches)-1][1]))
+	if err != nil {
+		return 0
+	}
+	return pages
+}
+
+// pageObject matches the dictionary of a page in a PDF, but not the /Pages
+// tree above it.
+var pageObject = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// pdfPages counts the pages in a PDF by looking for their objects. It's a
+// fallback for when the log doesn't say, and misses pages that are inside
+// compressed object streams.
+func pdfPages(pdf []byte) int {
+	return len(pageObject.FindAllIndex(pdf, -1))
+}
+
+// ParseLog picks the warnings gotex recognizes out of a LaTeX log, such as
+// RenderResult.Log. Render already does this for RenderResult.Warnings, but
+// ParseLog works on any log, including one left behind by a failed render.
+func ParseLog(log []byte) []Warning {
+	var warnings []Warning
+	var scanner = bufio.NewScanner(bytes.NewReader(log))
+	var message string
+	// continuing says the last line was a warning that may go on.
+	var continuing bool
+	for scanner.Scan() {
+		message += scanner.Text()
+		// Put lines TeX wrapped back together.
+		if len(scanner.Text()) == logLineWidth {
+			continue
+		}
+		// Packages continue their warnings on lines marked with their name.
+		if match := continuation.FindStringSubmatch(message); continuing && match != nil {
+			var warning = &warnings[len(warnings)-1]
+			warning.Message += " " + match[1]
+			if warning.Line == 0 {
+				warning.Line = findLine(match[1])
+			}
+			message = ""
+			continue
+		}
+		continuing = false
+		var kind WarningKind
+		switch {
+		case undefinedReference.MatchString(message):
+			kind = UndefinedReference
+		case undefinedCitation.MatchString(message):
+			kind = UndefinedCitation
+		case overfullBox.MatchString(message):
+			kind = OverfullBox
+		case underfullBox.MatchString(message):
+			kind = UnderfullBox
+		case strings.HasPrefix(message, "Missing character: "):
+			kind = MissingCharacter
+		case undefinedFontShape.MatchString(message):
+			kind = UndefinedFontShape
+		}
+		if kind != "" {
+			warnings = append(warnings, Warning{Kind: kind, Message: message,
+				Line: findLine(message)})
+			continuing = true
+		}
+		message = ""
+	}
+	return warnings
+}
+
+// findLine returns the document line a warning mentions, or 0.
+func findLine(message string) int {
+	var match = warningLine.FindStringSubmatch(message)
+	if match == nil {
+		return 0
+	}
+	var line, _ = strconv.Atoi(match[1])
+	return line
+}
+
+// maxOutput is how much of LaTeX's stdout and stderr gotex keeps. When
+// something goes wrong, the end is what matters.
+const maxOutput = 64 << 10
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns what the buffer holds.
+func (b *tailBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// errorLine matches the line that says where LaTeX was when it hit an error,
+// like "l.42 \foo".
+var errorLine = regexp.MustCompile(`^l\.(\d+) `)
+
+// fileLineError matches an error in the format -file-line-error gives, like
+// "./chapter.tex:42: Undefined control sequence."
+var fileLineError = regexp.MustCompile(`^(\S+\.\w+):(\d+): (.*)$`)
+
+// maxLogErrors is the most errors logErrors returns. A document that's badly
+// broken, or not LaTeX at all, can produce thousands in nonstopmode.
+const maxLogErrors = 100
+
+// logErrors picks the first maxLogErrors errors out of log.
+func logErrors(log []byte) []LatexErrorEntry {
+	var entries []LatexErrorEntry
+	var scanner = bufio.NewScanner(bytes.NewReader(log))
+	// entry is the error being read, and context its lines so far. After the
+	// "l.42" line, one more line finishes it.
+	var entry *LatexErrorEntry
+	var context []string
+	var finishing bool
+	var finish = func() {
+		if entry != nil {
+			entry.Context = strings.Join(context, "\n")
+			entries = append(entries, *entry)
+		}
+		entry, context, finishing = nil, nil, false
+	}
+	for len(entries) < maxLogErrors && scanner.Scan() {
+		var line = scanner.Text()
+		switch {
+		// TeX's closing "!  ==> Fatal error occurred" isn't an error of its
+		// own, but it does end the last one.
+		case strings.HasPrefix(line, "!  ==>"):
+			finish()
+		case strings.HasPrefix(line, "! "):
+			finish()
+			entry = &LatexErrorEntry{Message: strings.TrimPrefix(line, "! ")}
+		case fileLineError.MatchString(line):
+			finish()
+			var match = fileLineError.FindStringSubmatch(line)
+			entry = &LatexErrorEntry{File: match[1], Message: match[3]}
+			entry.Line, _ = strconv.Atoi(match[2])
+		case entry == nil:
+		case finishing:
+			context = append(context, line)
+			finish()
+		default:
+			context = append(context, line)
+			if match := errorLine.FindStringSubmatch(line); match != nil {
+				if entry.Line == 0 {
+					entry.Line, _ = strconv.Atoi(match[1])
+				}
+				finishing = true
+			}
+		}
+	}
+	if len(entries) < maxLogErrors {
+		finish()
+	}
+	return entries
+}
+
+// lineWriter splits what's written to it into lines and passes each one to
+// fn, without the newline. Several lineWriters can share mu so that fn is
+// never called concurrently.
+type lineWriter struct {
+	fn      func(line string)
+	mu      *sync.Mutex
+	pending []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, p...)
+	for {
+		var i = bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(strings.TrimSuffix(string(w.pending[:i]), "\r"))
+		w.pending = w.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush passes on a final line that didn't end in a newline.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.pending) > 0 {
+		w.fn(string(w.pending))
+		w.pending = nil
+	}
+}
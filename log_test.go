@@ -0,0 +1,120 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogPages(t *testing.T) {
+	var tests = map[string]int{
+		"Output written on gotex.pdf (12 pages, 34567 bytes).\n":                                   12,
+		"Output written on gotex.pdf (1 page, 4567 bytes).\n":                                      1,
+		"Output written on /a/very/long/path/that/was/wrapped/gote\nx.dvi (3 pages, 100 bytes).\n": 3,
+		"No pages of output.\n": 0,
+		"":                      0,
+	}
+	for log, want := range tests {
+		if pages := logPages([]byte(log)); pages != want {
+			t.Errorf("Wrong page count for %q: %d", log, pages)
+		}
+	}
+}
+
+func TestPdfPages(t *testing.T) {
+	var pdf = "%PDF-1.5\n1 0 obj << /Type /Pages /Kids [2 0 R 3 0 R] /Count 2 >>\n" +
+		"2 0 obj << /Type /Page /Parent 1 0 R >>\n" +
+		"3 0 obj <</Type/Page/Parent 1 0 R>>\n"
+	if pages := pdfPages([]byte(pdf)); pages != 2 {
+		t.Errorf("Should count 2 pages, got %d", pages)
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	// The natbib warning is wrapped at 79 characters.
+	var log = "This is pdfTeX, Version 3.141592653-2.6-1.40.25 (TeX Live 2023)\n" +
+		"LaTeX Warning: Reference `fig:1' on page 1 undefined on input line 12.\n\n" +
+		"LaTeX Warning: Citation `knuth' on page 1 undefined on input line 14.\n\n" +
+		"Package natbib Warning: Citation `lamport1994' on page 2 undefined on input lin\ne 20.\n\n" +
+		"Overfull \\hbox (12.3pt too wide) in paragraph at lines 30--32\n" +
+		"[]\\OT1/cmr/m/n/10 Some text|\n" +
+		"Underfull \\vbox (badness 10000) has occurred while \\output is active []\n" +
+		"Missing character: There is no ^^A in font cmr10!\n" +
+		"LaTeX Font Warning: Font shape `OT1/cmr/bx/it' undefined\n" +
+		"(Font)              using `OT1/cmr/bx/n' instead on input line 50.\n" +
+		"LaTeX Warning: There were undefined references.\n"
+	var want = []Warning{
+		{UndefinedReference, "LaTeX Warning: Reference `fig:1' on page 1 undefined on input line 12.", 12},
+		{UndefinedCitation, "LaTeX Warning: Citation `knuth' on page 1 undefined on input line 14.", 14},
+		{UndefinedCitation, "Package natbib Warning: Citation `lamport1994' on page 2 undefined on input line 20.", 20},
+		{OverfullBox, "Overfull \\hbox (12.3pt too wide) in paragraph at lines 30--32", 30},
+		{UnderfullBox, "Underfull \\vbox (badness 10000) has occurred while \\output is active []", 0},
+		{MissingCharacter, "Missing character: There is no ^^A in font cmr10!", 0},
+		{UndefinedFontShape, "LaTeX Font Warning: Font shape `OT1/cmr/bx/it' undefined using `OT1/cmr/bx/n' instead on input line 50.", 50},
+	}
+	var got = ParseLog([]byte(log))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong warnings:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	var b = &tailBuffer{max: 8}
+	for _, s := range []string{"abc", "defgh", "ijklmnopqrstuvwxyz", "0"} {
+		if n, err := b.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	if got := string(b.Bytes()); got != "tuvwxyz0" {
+		t.Errorf("Should keep the last 8 bytes, got %q", got)
+	}
+}
+
+func TestLogErrors(t *testing.T) {
+	var log = "(./gotex.tex\n" +
+		"! Undefined control sequence.\n" +
+		"l.42 \\foo\n" +
+		"          bar\n" +
+		"The control sequence at the end of the top line\n" +
+		"! LaTeX Error: File `missing.sty' not found.\n" +
+		"\n" +
+		"Enter file name: \n" +
+		"! Emergency stop.\n" +
+		"<read *> \n" +
+		"!  ==> Fatal error occurred, no output PDF file produced!\n"
+	var want = []LatexErrorEntry{
+		{"Undefined control sequence.", "", 42, "l.42 \\foo\n          bar"},
+		{"LaTeX Error: File `missing.sty' not found.", "", 0, "\nEnter file name: "},
+		{"Emergency stop.", "", 0, "<read *> "},
+	}
+	var got = logErrors([]byte(log))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong errors:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLogErrorsFileLine(t *testing.T) {
+	var log = "(./chapters/one.tex\n" +
+		"./chapters/one.tex:7: Undefined control sequence.\n" +
+		"l.7 \\foo\n" +
+		"          bar\n" +
+		"./book.tex:3: LaTeX Error: Environment foo undefined.\n"
+	var want = []LatexErrorEntry{
+		{"Undefined control sequence.", "./chapters/one.tex", 7, "l.7 \\foo\n          bar"},
+		{"LaTeX Error: Environment foo undefined.", "./book.tex", 3, ""},
+	}
+	var got = logErrors([]byte(log))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong errors:\n got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestLogErrorsLimit(t *testing.T) {
+	var log = strings.Repeat("! Undefined control sequence.\nl.1 \\foo\n\n", 3*maxLogErrors)
+	if got := len(logErrors([]byte(log))); got != maxLogErrors {
+		t.Errorf("Should stop at %d errors, got %d", maxLogErrors, got)
+	}
+}
@@ -31,33 +31,452 @@
 //	        sendSomewhere(pdf)
 //	    }
 //	}
+//
+// All the Render functions are safe to call from multiple goroutines at once,
+// even with the same Options. Each render gets its own temporary directory and
+// LaTeX process, and gotex doesn't change the process's environment or working
+// directory. Options is only read, so its maps and slices must not be changed
+// while a render is using them, and callbacks such as OnRun must be safe to
+// call concurrently when Options is shared.
 package gotex
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
+// Metadata is the title and such that PDF viewers show in a document's
+// properties. gotex sets it by loading hyperref and calling \hypersetup just
+// before \begin{document}, which needs LaTeX from 2020 or later. Values set
+// here replace any the document gives with its own \hypersetup, and hyperref
+// is loaded even if the document doesn't use it, which can change how it
+// looks. Only documents given to the Render functions as strings or readers
+// get it, not those from RenderFile or RenderProject. It can't be combined with
+// Options.Format, since a format skips the preamble it's put in.
+type Metadata struct {
+	Title    string
+	Author   string
+	Subject  string
+	Keywords string
+}
+
+// preamble returns the TeX that sets m, or "" if there's nothing to set. It
+// doesn't end the line, so the document's line numbers stay the same.
+func (m Metadata) preamble() string {
+	var keys []string
+	for _, kv := range []struct{ key, value string }{
+		{"pdftitle", m.Title},
+		{"pdfauthor", m.Author},
+		{"pdfsubject", m.Subject},
+		{"pdfkeywords", m.Keywords},
+	} {
+		if kv.value != "" {
+			keys = append(keys, kv.key+"={"+EscapeString(kv.value)+"}")
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	return "\\AddToHook{begindocument/before}{\\RequirePackage{hyperref}" +
+		"\\hypersetup{" + strings.Join(keys, ",") + "}}"
+}
+
+// Logger receives gotex's progress messages. It is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// DefaultRerunPatterns are the log messages that ask for another run unless
+// Options.RerunPatterns says otherwise. They cover the LaTeX kernel's label
+// and citation warnings, hyperref, longtable, rerunfilecheck, and biblatex.
+// "There were undefined references" isn't one of them, since a document with
+// a truly missing \ref prints it on every run.
+var DefaultRerunPatterns = []string{
+	"Rerun to get",
+	"Label(s) may have changed",
+	"Rerun LaTeX",
+	"Please (re)run Biber",
+}
+
+// killGracePeriod is how long a LaTeX process and anything it started have to
+// exit after being sent SIGTERM before they are killed outright.
+const killGracePeriod = 2 * time.Second
+
 // Options contains the knobs used to change gotex's behavior.
 type Options struct {
-	// Command is the executable to run. It defaults to "pdflatex". Set this to
-	// a full path if $PATH will not be defined in your app's environment.
+	// Engine is the TeX engine to use. It defaults to PdfLaTeX.
+	Engine Engine
+	// OutputFormat is the kind of file to produce. It defaults to PDF.
+	OutputFormat OutputFormat
+	// DvipsCommand is the dvips executable used to produce PS output. It
+	// defaults to "dvips".
+	DvipsCommand string
+	// DvisvgmCommand is the dvisvgm executable used by RenderSVG. It defaults
+	// to "dvisvgm".
+	DvisvgmCommand string
+	// DvisvgmArgs are extra arguments for dvisvgm, such as "--no-fonts" to
+	// draw glyphs as paths or "--font-format=woff" to embed web fonts.
+	DvisvgmArgs []string
+	// Rasterizer is the program RenderImage uses to turn PDF into PNG. It may
+	// be "pdftoppm", the default, or "ghostscript".
+	Rasterizer string
+	// PdftoppmCommand is the pdftoppm executable. It defaults to "pdftoppm".
+	PdftoppmCommand string
+	// GhostscriptCommand is the Ghostscript executable. It defaults to "gs".
+	GhostscriptCommand string
+	// PDFA makes the output PDF/A-1b, 2b, or 3b, for archiving, when set to
+	// 1, 2, or 3. LaTeX's PDF is converted by Ghostscript, which replaces
+	// its colors with RGB ones and adds PDFAProfile as the output intent.
+	// Ghostscript has to be installed; if it isn't, the render fails with an
+	// error wrapping ErrCommandNotFound. If the document has something that
+	// can't be made compliant, Ghostscript fails and so does the render, with
+	// a ToolError, rather than produce a PDF that isn't. OutputFormat must be
+	// PDF.
+	PDFA int
+	// PDFAProfile is the path to the sRGB ICC profile that PDFA needs, such
+	// as the srgb.icc that comes with Ghostscript. It is required with PDFA.
+	PDFAProfile string
+	// Optimize runs the PDF through Ghostscript to make it smaller, mostly by
+	// downsampling color and grayscale images to OptimizeDPI and compressing
+	// what LaTeX left uncompressed. Monochrome images, such as scanned text,
+	// are left alone. Ghostscript has to be installed, and OutputFormat must
+	// be PDF. It happens before PDFA, if both are set.
+	Optimize bool
+	// OptimizeDPI is the resolution Optimize downsamples images to. It
+	// defaults to 150, which is fine on screen but coarse in print.
+	OptimizeDPI int
+	// InfoDate, if set, replaces the creation and modification dates in the
+	// PDF's document properties, for reproducible output where
+	// SOURCE_DATE_EPOCH isn't supported. InfoProducer, if set, replaces the
+	// producer, usually the engine's name and version. The PDF is changed by
+	// appending an incremental update, so everything else in it is left
+	// alone. That doesn't touch XMP metadata, so neither can be used with
+	// PDFA, which needs the two to match. OutputFormat must be PDF.
+	InfoDate     time.Time
+	InfoProducer string
+	// Command is the executable to run. It defaults to the program that runs
+	// Engine to produce OutputFormat, such as "pdflatex" or "latex". Set this
+	// to a full path if $PATH will not be defined in your app's environment.
+	// It should run the same program the default would.
 	Command string
 	// Runs determines how many times Command is run. This is needed for
 	// documents that use refrences and packages that require multiple passes.
 	// If 0, gotex will automagically attempt to determine how many runs are
 	// required by parsing LaTeX log output.
 	Runs int
+	// MaxRuns caps the number of runs in automagic mode. It defaults to 5,
+	// which may be too few for a document with an index, a bibliography, and
+	// lots of cross-references. It has no effect when Runs is set.
+	MaxRuns int
+	// FailOnWarnings makes the render fail with a *WarningError if the log
+	// has warnings of any of these kinds, such as UndefinedReference. The
+	// output is still produced; see WarningError.
+	FailOnWarnings []WarningKind
+	// RerunPatterns are the log messages that mean LaTeX needs another run.
+	// They match anywhere in a line, ignoring case. If nil,
+	// DefaultRerunPatterns is used.
+	RerunPatterns []string
+	// Logger, if set, is told what gotex is doing as it goes: each run, each
+	// command it starts, and what it decides about rerunning. A *log.Logger
+	// will do.
+	Logger Logger
+	// RerunFunc, if set, is called with each line of the log and returns
+	// whether it asks for another run. It replaces RerunPatterns.
+	RerunFunc func(line string) bool
 
 	// Texinputs is a colon-separated list of directories containing assests
 	// such as image files that are needed to compile the document. It is added
 	// to $TEXINPUTS for the LaTeX process.
 	Texinputs string
+	// TexinputsDirs is a list of additional asset directories, such as a
+	// shared repository of .sty and .cls files. They are joined with the OS
+	// path list separator and added to $TEXINPUTS after Texinputs.
+	TexinputsDirs []string
+	// FontDirs are directories of OpenType and TrueType fonts for fontspec,
+	// so a document can use fonts that aren't installed. They should be
+	// absolute, since LaTeX runs in the temporary directory. They are put in
+	// $OSFONTDIR, which LuaLaTeX searches for fonts by name or file name, and
+	// at the front of $OPENTYPEFONTS and $TTFONTS, which both XeLaTeX and
+	// LuaLaTeX search by file name. XeLaTeX looks up fonts by name through
+	// fontconfig instead, so with it, give the file name, as in
+	// \setmainfont{Brand.otf}. pdfLaTeX can't use these fonts at all.
+	FontDirs []string
+
+	// InteractionMode controls what LaTeX does when it hits an error. The
+	// default, "halt-on-error", stops at the first error, which is then
+	// reported in LatexError.Message. "nonstopmode", "batchmode", and
+	// "scrollmode" are passed to LaTeX as -interaction= and let it carry on
+	// past errors so every one of them ends up in the log, though the first
+	// is still the one reported. LaTeX exits with an error status in any case,
+	// so the render fails either way. "errorstopmode" makes LaTeX prompt for
+	// input that can't come, since stdin is the document itself, so it's
+	// rejected.
+	InteractionMode string
+
+	// ShellEscape lets the document run external commands, which packages
+	// like minted need. WARNING: ShellEscapeEnabled lets the document run
+	// arbitrary commands as your process's user, so a document from an
+	// untrusted source can read or delete your files, or worse. Never use it
+	// for documents you didn't write. Even ShellEscapeRestricted is only as
+	// safe as the list of allowed commands in texmf.cnf. The default,
+	// ShellEscapeDisabled, is the only safe choice for untrusted input.
+	ShellEscape ShellEscapeMode
+
+	// ExtraArgs are passed to LaTeX after the arguments gotex adds, such as
+	// -jobname and -interaction. LaTeX lets the last of a repeated option win,
+	// so ExtraArgs can override those, but doing so may confuse gotex about
+	// where to find the output.
+	ExtraArgs []string
+	// Cache, if set, is checked for output from an earlier render of the same
+	// document with the same options before running LaTeX, and the output of
+	// each successful render is stored in it. The key covers the document,
+	// Files, FS, Format, Env, and the options that affect how LaTeX and the
+	// other tools run, but not files LaTeX finds elsewhere, such as through
+	// Texinputs, or RerunFunc. RenderFile doesn't use the cache, since the
+	// file's directory could hold anything.
+	Cache Cache
+	// Metadata is put in the PDF's document properties. See Metadata for how.
+	Metadata Metadata
+	// Format is a format file from CompileFormat. LaTeX starts from it
+	// instead of the engine's usual format, which saves processing the
+	// preamble it was made from. It is only read, so one format can be shared
+	// by any number of renders at once.
+	Format []byte
+	// WriteSource writes the document to <Jobname>.tex in the temporary
+	// directory and has LaTeX compile that file, instead of piping the
+	// document to it over stdin. Some packages, such as minted, and shell
+	// escape tools need the document to be a real file, as does anything
+	// that reads the main file again, like \input{\jobname}. Errors then
+	// name the file, too, when FileLineError is set. It has no effect on
+	// RenderFile and RenderProject, which always compile a file.
+	WriteSource bool
+	// FileLineError passes -file-line-error, so LaTeX reports errors with the
+	// file they're in, which then shows up in LatexError.Errors. It's mostly
+	// useful when the document is split across files, as with RenderProject.
+	FileLineError bool
+	// SyncTeX passes -synctex=1, so LaTeX writes the data editors and viewers
+	// use to jump between the source and the PDF. It is returned in
+	// RenderResult.SyncTeX. The paths in it are those LaTeX read the document
+	// from, which for anything but RenderFile is the temporary directory.
+	SyncTeX bool
+	// ReturnAux returns the files, other than the output and the log, that
+	// LaTeX and the tools it ran wrote for the jobname, such as the .aux,
+	// .toc, and .bbl files, in RenderResult.Aux.
+	ReturnAux bool
+	// Aux are auxiliary files from an earlier render's RenderResult.Aux. They
+	// are written into the temporary directory, after Files, so LaTeX starts
+	// with the cross-references it worked out last time. If the document
+	// hasn't changed in a way that moves them, a single pass is enough: the
+	// aux file coming out the same as it went in counts as settled, and
+	// BibTeX, biber, and makeindex aren't run again if their output is
+	// there and their input hasn't changed.
+	Aux map[string][]byte
+
+	// Timeout limits how long the whole render may take. It is a single budget
+	// shared by every run, so in automagic mode (Runs == 0) a document that
+	// needs several passes gets less time per pass. If it expires, the LaTeX
+	// process is sent SIGTERM, then killed if it hasn't exited after a short
+	// grace period, and an error wrapping ErrTimeout is returned. Like other
+	// failures, the temporary directory is left behind so you can see where
+	// the log stopped. If 0, there is no limit beyond that of the context
+	// passed to RenderContext.
+	Timeout time.Duration
+
+	// OnRun, if set, is called at the start of each LaTeX run with the run
+	// number, starting from 1, and the total, for things like progress
+	// reporting. The total is Runs if that was set. In automagic mode, the
+	// number of runs isn't known until the last one is done, so it's the
+	// MaxRuns limit instead, and the render usually finishes well short of
+	// it. OnRun is called from the goroutine that called Render, and never
+	// after Render returns.
+	OnRun func(run, total int)
+	// OnLogLine, if set, is called with each line LaTeX prints to stdout or
+	// stderr, as it prints it. LaTeX prints most of its log this way, though
+	// it wraps long lines. OnLogLine may be called from another goroutine,
+	// but never concurrently, and never after Render returns.
+	OnLogLine func(line string)
+
+	// KeepTemp leaves the temporary directory in place even when the render
+	// succeeds, so you can inspect the .aux and other intermediate files. Its
+	// path is returned in RenderResult.Dir. The caller becomes responsible for
+	// removing it; otherwise every render leaks a directory.
+	KeepTemp bool
+	// CleanOnError removes the temporary directory even when the render
+	// fails. The log is still in the error, such as LatexError.Log, but any
+	// paths in it no longer exist. KeepTemp overrides it.
+	CleanOnError bool
+	// DryRun sets up the temporary directory as usual, but returns a
+	// *DryRunError describing the first LaTeX command instead of running it.
+	// The document is written to a file as with WriteSource, and the
+	// directory is left behind, even with CleanOnError, so the command can be
+	// run by hand from there.
+	// The cache isn't consulted.
+	DryRun bool
+
+	// TempDir is the directory in which the temporary directory for each
+	// render is created. It must already exist and be writable; if it doesn't
+	// exist, the render fails before LaTeX is run. If empty, the system
+	// default from os.TempDir is used. Pointing this at a larger volume helps
+	// where /tmp is small or read-only, and a tmpfs can speed renders up.
+	TempDir string
+
+	// Jobname is passed to LaTeX as -jobname=, and so determines the names of
+	// the output and log files as well as the value of \jobname inside the
+	// document. It defaults to "gotex". It may not contain path separators,
+	// whitespace, or characters that are special to the shell. It is only the
+	// name inside the temporary directory; RenderToFile can put the output
+	// under any name, which needn't match.
+	Jobname string
+
+	// Files are written into the temporary directory before LaTeX runs, so
+	// the document can \input, \includegraphics, or \usepackage them. Keys
+	// are slash-separated paths relative to the temporary directory; missing
+	// parent directories are created. Absolute paths and paths containing
+	// ".." are rejected.
+	Files map[string][]byte
+
+	// FS is a tree of extra input files, such as an embed.FS holding a
+	// template's styles, fonts, and images. It is copied into the temporary
+	// directory before Files is written, so Files wins if both have the same
+	// name. Symlinks and other irregular files are skipped.
+	FS fs.FS
+
+	// BibEngine is the bibliography tool to run on the jobname after the first
+	// LaTeX pass if the document has a bibliography. It may be "bibtex", which
+	// runs when the aux file has citations and a \bibliography, or "biber",
+	// which runs when biblatex has written a .bcf control file. "auto" picks
+	// whichever of the two the document needs, if any. In automagic mode, two
+	// more passes are always run afterwards so the references resolve. If
+	// "none", or if neither this nor BibCommand is set, no bibliography tool
+	// is run and citations come out as "[?]".
+	BibEngine string
+	// BibCommand is the executable for BibEngine. It defaults to the name of
+	// the engine that runs. If it is set but BibEngine isn't, BibEngine is
+	// "bibtex".
+	BibCommand string
+
+	// MakeIndex runs makeindex on the .idx file once a LaTeX pass writes one,
+	// which documents using \makeindex do, and then runs LaTeX again to pick
+	// up the generated index. This is repeated if the new pass changes the
+	// .idx file, so the page numbers in the index match the final document.
+	// A makeindex failure is returned as a ToolError.
+	MakeIndex bool
+	// MakeIndexCommand is the makeindex executable. It defaults to
+	// "makeindex".
+	MakeIndexCommand string
+	// MakeIndexArgs are extra arguments, such as "-s" and a style file, that
+	// are passed to makeindex before the name of the .idx file.
+	MakeIndexArgs []string
+	// Glossaries runs makeglossaries once a LaTeX pass writes a .glo or .acn
+	// file, which documents using the glossaries package with \makeglossaries
+	// do, and then runs LaTeX again to pick up the glossaries. Like the index,
+	// this is repeated until those files settle. A makeglossaries failure is
+	// returned as a ToolError.
+	Glossaries bool
+	// GlossariesCommand is the makeglossaries executable. It defaults to
+	// "makeglossaries".
+	GlossariesCommand string
+	// Latexmk hands the document to latexmk, which decides for itself how
+	// many passes to make and which of BibTeX, biber, makeindex, and the like
+	// to run, instead of gotex doing so. latexmk is told to use Command for
+	// the engine, and LaTeX gets the same options it otherwise would. Runs,
+	// MaxRuns, BibEngine, MakeIndex, and Glossaries are ignored, and so are
+	// RerunPatterns and RerunFunc except for setting Converged. Since latexmk
+	// can't read stdin, the document is written to a file as with
+	// WriteSource. A latexmk failure is returned as a LatexError, with the
+	// log of the last LaTeX pass.
+	Latexmk bool
+	// LatexmkCommand is the latexmk executable. It defaults to "latexmk".
+	LatexmkCommand string
+
+	// Env sets environment variables for LaTeX and the tools gotex runs, such
+	// as SOURCE_DATE_EPOCH for reproducible output or HOME for fontconfig.
+	// They are added to the inherited environment, replacing any variables of
+	// the same name. If Texinputs or TexinputsDirs is also set, a TEXINPUTS
+	// set here is searched after them.
+	Env map[string]string
+	// ClearEnv starts the child processes with an empty environment instead
+	// of inheriting gotex's, so only Env and the variables gotex sets itself
+	// are present. Command will likely need to be a full path, or Env will
+	// need to set PATH.
+	ClearEnv bool
+	// Reproducible sets SOURCE_DATE_EPOCH and FORCE_SOURCE_DATE so that the
+	// engines use a fixed date for the PDF's timestamps and ID, rather than
+	// the current time. The date is the Unix epoch unless Env sets
+	// SOURCE_DATE_EPOCH. FORCE_SOURCE_DATE also sets \year, \month, \day,
+	// and \time from it, so with the default, \today prints January 1, 1970.
+	// Set SOURCE_DATE_EPOCH in Env to the date the document should show.
+	// Only the date is fixed: other things can still differ between runs,
+	// such as random numbers or files that change, so identical output isn't
+	// guaranteed.
+	Reproducible bool
+}
+
+// RenderResult holds everything produced by a successful render.
+type RenderResult struct {
+	// Pdf is the rendered document. Despite the name, it is in whatever
+	// format Options.OutputFormat asked for.
+	Pdf []byte
+	// Log is the contents of the LaTeX log file from the last run.
+	Log []byte
+	// Runs is the number of times LaTeX was run.
+	Runs int
+	// Converged is false if the last run still left work for another, either
+	// because LaTeX asked for a rerun or because a tool like BibTeX produced
+	// something it hasn't read yet. In automagic mode, that means it gave up at
+	// the run limit while the aux file was still changing, or stopped early
+	// because it wasn't; Stalled tells them apart. Either usually signals a
+	// real cross-reference problem.
+	// With Options.Runs set, it means Runs was too low. Either way, the output
+	// may have wrong references.
+	Converged bool
+	// Stalled is true if automagic mode stopped early because the log kept
+	// asking for a rerun but the aux file came out the same each time. The
+	// output is probably as good as it gets. If Converged is false and
+	// Stalled isn't, the run limit was hit while things were still changing,
+	// so more runs might have helped.
+	Stalled bool
+	// Pages is the number of pages in the output, as reported in the log. If
+	// the log doesn't say and the output is a PDF, gotex counts the page
+	// objects in it instead, which can come up short or find none when they
+	// are in compressed object streams.
+	Pages int
+	// Warnings are the undefined references, bad boxes, and other problems
+	// LaTeX reported on its last run.
+	Warnings []Warning
+	// BibLog is the log written by the bibliography tool, if one ran.
+	BibLog []byte
+	// SyncTeX is the gzipped .synctex.gz file, if Options.SyncTeX was set.
+	// It isn't cached, so it is nil when Cached is true.
+	SyncTeX []byte
+	// Aux holds the files Options.ReturnAux asks for, by name, such as
+	// "gotex.aux". Like SyncTeX, it is nil when Cached is true.
+	Aux map[string][]byte
+	// Stdout and Stderr are the raw output of the last LaTeX run. Only the
+	// last 64 KiB of each is kept.
+	Stdout []byte
+	Stderr []byte
+	// Cached is true if the output came from Options.Cache, in which case
+	// LaTeX didn't run and most of the other fields are empty.
+	Cached bool
+	// Dir is the temporary directory LaTeX ran in. It is only set if the
+	// directory was left behind, either because the render failed or because
+	// Options.KeepTemp is set.
+	Dir string
 }
 
 // Render takes the LaTeX document to be rendered as a string. It returns the
@@ -65,83 +484,864 @@ type Options struct {
 // temporary directory intact so you can check the log file to see what
 // happened. The error will tell you where to find it.
 func Render(document string, options Options) ([]byte, error) {
-	// Set default options.
-	if options.Command == "" {
-		options.Command = "pdflatex"
+	return RenderContext(context.Background(), document, options)
+}
+
+// RenderReader is like Render, but reads the document from r, which saves
+// converting a large document to a string. LaTeX may need to read it more
+// than once, so if r is an io.Seeker, it is rewound to where it started for
+// each run. Otherwise, it is read into memory first, unless Options.Runs is 1.
+func RenderReader(r io.Reader, options Options) ([]byte, error) {
+	var output bytes.Buffer
+	var _, err = render(context.Background(), r, options, copyTo(&output))
+	if err != nil {
+		return nil, err
 	}
+	return output.Bytes(), nil
+}
 
-	// Create the temporary directory where LaTeX will dump its ugliness.
-	var dir, err = ioutil.TempDir("", "gotex-")
+// RenderFile is like Render, but compiles the document in filename. Unlike the
+// other Render functions, LaTeX runs in the file's directory, so relative
+// \input, \include, and \includegraphics paths resolve the way they would from
+// the command line. Everything LaTeX writes still goes to the temporary
+// directory, which is cleaned up as usual, so nothing is written next to
+// filename. TeX won't create subdirectories there, though, so \include of a
+// file in a subdirectory fails. BibTeX also looks for .bib files in the
+// file's directory.
+func RenderFile(filename string, options Options) ([]byte, error) {
+	var file, err = filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	// Check up front, since a missing directory would otherwise look like a
+	// missing LaTeX command.
+	if _, err := os.Stat(file); err != nil {
+		return nil, err
+	}
+	var output bytes.Buffer
+	_, err = renderSource(context.Background(), &source{file: file}, options, copyTo(&output))
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// RenderContext is like Render, but the LaTeX process is killed if ctx is
+// cancelled or its deadline passes before rendering finishes. The context is
+// also checked between runs. In that case the temporary directory is removed
+// and the returned error wraps ctx.Err(), so errors.Is works as expected.
+func RenderContext(ctx context.Context, document string, options Options) ([]byte, error) {
+	var output bytes.Buffer
+	var _, err = render(ctx, strings.NewReader(document), options, copyTo(&output))
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// RenderFull is like Render, but returns the LaTeX log and the number of runs
+// along with the PDF. If LaTeX fails, the returned RenderResult still holds
+// whatever log was written, so the caller doesn't have to go looking for it.
+// With a *WarningError, the PDF is returned too.
+func RenderFull(document string, options Options) (RenderResult, error) {
+	var output bytes.Buffer
+	var result, err = render(context.Background(), strings.NewReader(document), options, copyTo(&output))
+	var warningErr *WarningError
+	if err == nil || errors.As(err, &warningErr) {
+		result.Pdf = output.Bytes()
+	}
+	return result, err
+}
+
+// RenderTo is like Render, but copies the PDF to w instead of returning it,
+// so a large document never has to be held in memory. It returns the number
+// of bytes written. If copying fails part way through, w will have been
+// partially written.
+func RenderTo(w io.Writer, document string, options Options) (int64, error) {
+	var counter = &countingWriter{w: w}
+	var _, err = render(context.Background(), strings.NewReader(document), options, copyTo(counter))
+	return counter.n, err
+}
+
+// RenderToFile is like Render, but writes the PDF to outPath, creating any
+// missing parent directories. The file is moved into place with a rename, so
+// outPath is never left partially written; if it already exists, it is
+// replaced.
+func RenderToFile(outPath, document string, options Options) error {
+	var _, err = render(context.Background(), strings.NewReader(document), options,
+		func(ctx context.Context, options Options, name string) error {
+			return moveFile(name, outPath)
+		})
+	return err
+}
+
+// RunLatex runs LaTeX once on document in dir, which must already exist, and
+// returns the log. It does none of Render's orchestration: no temporary
+// directory, no reruns, and no bibliography or index tools. That makes it a
+// building block for pipelines with their own idea of when a document is
+// finished. Options that only matter to the pipeline, like Runs, Timeout,
+// and TempDir, are ignored; use ctx for a deadline. Files, FS, and Format
+// aren't written to dir either, so put whatever the document needs there
+// first; to start from a format file, pass -fmt in ExtraArgs. Metadata is
+// set as it is by Render. With Latexmk or WriteSource, the document is
+// written to <Jobname>.tex in dir, replacing any file of that name, and LaTeX
+// or latexmk is given that file. If LaTeX fails, the error is a *LatexError,
+// and whatever log there is is still returned.
+func RunLatex(ctx context.Context, document io.Reader, options Options, dir string) ([]byte, error) {
+	options.Format = nil
+	options, err := setDefaults(options)
 	if err != nil {
 		return nil, err
 	}
+	if preamble := options.Metadata.preamble(); preamble != "" {
+		document = io.MultiReader(strings.NewReader(preamble), document)
+	}
+	// latexmk needs a file to work on, so write the document out first.
+	var file string
+	if options.Latexmk || options.WriteSource {
+		var src *source
+		src, err = writeSource(dir, options.Jobname+".tex", &source{r: document})
+		if err != nil {
+			return nil, err
+		}
+		file, document = src.file, nil
+	}
+	_, _, err = runLatex(ctx, document, file, options, dir)
+	return readLog(path.Join(dir, options.Jobname+".log")), err
+}
+
+// deliverFunc puts the output file, given by name, wherever the caller of
+// render wants it. It is given the render's context and options, with the
+// defaults filled in.
+type deliverFunc func(ctx context.Context, options Options, name string) error
+
+// render does the work behind all the Render functions. Once the output is
+// ready, deliver is called with its path. render doesn't fill in
+// RenderResult.Pdf.
+func render(ctx context.Context, document io.Reader, options Options, deliver deliverFunc) (RenderResult, error) {
+	if preamble := options.Metadata.preamble(); preamble != "" {
+		document = io.MultiReader(strings.NewReader(preamble), document)
+	}
+	// Hashing the document for the cache reads it once more.
+	var runs = options.Runs
+	if options.Cache != nil {
+		runs = 0
+	}
+	var source, err = newSource(document, runs)
+	if err != nil {
+		return RenderResult{}, err
+	}
+	return renderSource(ctx, source, options, deliver)
+}
+
+// renderSource is render for a document that has already been wrapped in a
+// source.
+func renderSource(ctx context.Context, source *source, options Options, deliver deliverFunc) (RenderResult, error) {
+	var result, err = compile(ctx, source, options, deliver)
+	// By now, the error and result hold the logs, so the directory isn't
+	// needed, unless it's where a dry run's command is meant to run.
+	var dryRun *DryRunError
+	if err != nil && options.CleanOnError && !options.KeepTemp && result.Dir != "" &&
+		!errors.As(err, &dryRun) {
+		_ = os.RemoveAll(result.Dir)
+		result.Dir = ""
+	}
+	return result, err
+}
+
+// compile does the work of renderSource, leaving the temporary directory
+// behind on failure.
+func compile(ctx context.Context, source *source, options Options, deliver deliverFunc) (RenderResult, error) {
+	var result RenderResult
+
+	options, err := setDefaults(options)
+	if err != nil {
+		return result, err
+	}
+
+	// The timeout covers all runs, so it wraps the whole render.
+	var parent = ctx
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	// Don't bother setting anything up if the context is already done.
+	if err := ctx.Err(); err != nil {
+		return result, fmt.Errorf("gotex: render aborted: %w", err)
+	}
+
+	// A document read from outside the temporary directory may depend on
+	// anything next to it, so it can't be cached.
+	var key string
+	if options.Cache != nil && !options.DryRun && !filepath.IsAbs(source.file) {
+		var document, err = source.next()
+		if err == nil {
+			key, err = cacheKey(document, source.file, options)
+		}
+		if err != nil {
+			return result, err
+		}
+		if output, ok := options.Cache.Get(key); ok {
+			logf(options, "gotex: using cached output")
+			return renderCached(ctx, options, output, deliver)
+		}
+	}
+
+	// BibTeX and makeindex run in the temporary directory, so point them back
+	// at the document's own directory for its .bib and style files.
+	if filepath.IsAbs(source.file) {
+		options.Env = searchFirst(options, "BIBINPUTS", filepath.Dir(source.file))
+	}
+
+	// Create the temporary directory where LaTeX will dump its ugliness.
+	dir, err := makeTempDir(options.TempDir)
+	if err != nil {
+		return result, err
+	}
+	result.Dir = dir
+	logf(options, "gotex: working in %s", dir)
+	var logFile = path.Join(dir, options.Jobname+".log")
+
+	// Put any extra input files where LaTeX will find them.
+	err = copyFS(dir, options.FS)
+	if err == nil {
+		err = writeFiles(dir, options.Files)
+	}
+	if err == nil {
+		err = writeFiles(dir, options.Aux)
+	}
+	if err == nil && len(options.Format) > 0 {
+		err = ioutil.WriteFile(path.Join(dir, formatName+".fmt"), options.Format, 0644)
+	}
+	if err == nil && (options.WriteSource || options.Latexmk || options.DryRun) &&
+		source.file == "" {
+		source, err = writeSource(dir, options.Jobname+".tex", source)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		result.Dir = ""
+		return result, err
+	}
 	// The directory cleanup is purposefully not deferred here because we need
 	// to leave the log file for postmortem in the case of failure.
 
+	// latexmk does its own passes and runs the tools it needs in between.
+	if options.Latexmk {
+		options.Runs = 1
+		options.BibEngine = "none"
+		options.MakeIndex = false
+		options.Glossaries = false
+	}
+
 	// Unless a number was given, don't let automagic mode run more than this
 	// many times.
 	var maxRuns = 5
+	if options.MaxRuns > 0 {
+		maxRuns = options.MaxRuns
+	}
 	if options.Runs > 0 {
 		maxRuns = options.Runs
 	}
 	// Keep running until the document is finished or we hit an arbitrary limit.
-	var runs int
-	for rerun := true; rerun && runs < maxRuns; runs++ {
-		err = runLatex(document, options, dir)
+	// minRuns lets a tool like BibTeX insist on more passes even if the log
+	// doesn't ask for them.
+	var bibDone bool
+	var minRuns int
+	// index is the .idx file makeindex last ran on, and glossaries are the
+	// files makeglossaries last ran on.
+	var index, glossaries []byte
+	// rerun says whether the output is still unfinished. Only automagic mode
+	// acts on it, but it's tracked either way to fill in Converged.
+	var rerun = true
+	// aux is a hash of the aux file after the last run, and stalled says
+	// another run wouldn't change it.
+	var aux [sha256.Size]byte
+	var stalled bool
+	// Files from an earlier render say where the last one got to.
+	var given, seeded = options.Aux[options.Jobname+".aux"]
+	if seeded {
+		aux = sha256.Sum256(given)
+	}
+	if _, ok := options.Aux[options.Jobname+".ind"]; ok {
+		index = options.Aux[options.Jobname+".idx"]
+	}
+	for (options.Runs > 0 || (rerun && !stalled) || result.Runs < minRuns) && result.Runs < maxRuns {
+		// Don't start another pass if the caller has given up. The context is
+		// checked again afterwards because a cancelled pass looks like a
+		// failed one, but the log it leaves behind is not worth keeping.
+		if ctx.Err() == nil {
+			// A dry run doesn't count, since nothing runs.
+			if !options.DryRun {
+				result.Runs++
+				logf(options, "gotex: starting run %d", result.Runs)
+				if options.OnRun != nil {
+					options.OnRun(result.Runs, maxRuns)
+				}
+			}
+			var document io.Reader
+			document, err = source.next()
+			if err == nil {
+				result.Stdout, result.Stderr, err = runLatex(ctx, document, source.file, options, dir)
+			}
+		}
+		if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+			return result, err
+		}
+		if errors.Is(err, ErrCommandNotFound) {
+			// LaTeX never ran, so there's nothing in the directory to see.
+			_ = os.RemoveAll(dir)
+			result.Dir = ""
+			return result, err
+		}
 		if err != nil {
-			return nil, err
+			result.Log = readLog(logFile)
+			return result, err
+		}
+		// Determine whether we need to run again.
+		rerun = needsRerun(logFile, options.RerunFunc)
+
+		// Some documents ask for a rerun forever. LaTeX only learns something
+		// new from a run through the aux file, so if that came out the same as
+		// last time, neither will the next run.
+		var sum, ok = auxSum(options, dir)
+		stalled = ok && (result.Runs > 1 || seeded) && sum == aux
+		aux = sum
+		// The citations are in the aux file, so if it's the one that went
+		// with the given .bbl, the bibliography is up to date.
+		if _, ok := options.Aux[options.Jobname+".bbl"]; ok && result.Runs == 1 && stalled {
+			bibDone = true
 		}
-		// If in automagic mode, determine whether we need to run again.
-		if options.Runs == 0 {
-			rerun = needsRerun(dir)
+		if rerun && stalled {
+			logf(options, "gotex: log asks for another run, but the aux file didn't change")
+		} else if rerun {
+			logf(options, "gotex: log asks for another run")
+		}
+
+		// The first pass writes the citations to the aux file. Once the
+		// bibliography tool has turned them into a .bbl file, LaTeX has to
+		// run twice more: once to read it and once to resolve the labels it
+		// defines.
+		if engine := bibEngine(options, dir); !bibDone && engine != "" {
+			bibDone = true
+			result.BibLog, err = runBib(ctx, options, dir, engine)
+			if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+				return result, err
+			}
+			if err != nil {
+				result.Log = readLog(logFile)
+				return result, err
+			}
+			rerun = true
+			stalled = false
+			minRuns = result.Runs + 2
+		}
+
+		// Likewise, the index is built from the .idx file and read back in.
+		// Reading it can move things to different pages, which changes the
+		// .idx file, so run makeindex again until it settles.
+		if idx, changed := indexChanged(options, dir, index); options.MakeIndex && changed {
+			index = idx
+			err = runMakeIndex(ctx, options, dir)
+			if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+				return result, err
+			}
+			if err != nil {
+				result.Log = readLog(logFile)
+				return result, err
+			}
+			rerun = true
+			stalled = false
+		}
+
+		// Glossaries work the same way.
+		if glo, changed := glossariesChanged(options, dir, glossaries); options.Glossaries && changed {
+			glossaries = glo
+			err = runMakeGlossaries(ctx, options, dir)
+			if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+				return result, err
+			}
+			if err != nil {
+				result.Log = readLog(logFile)
+				return result, err
+			}
+			rerun = true
+			stalled = false
+		}
+	}
+
+	// If the log still wants another run, the limit cut it short and the
+	// cross-references may be wrong.
+	result.Converged = !rerun
+	// With a fixed number of runs, nothing stops early.
+	result.Stalled = options.Runs == 0 && rerun && stalled
+
+	// Convert the output if LaTeX can't produce the format directly. latexmk
+	// already has.
+	if options.OutputFormat == PS && !options.Latexmk {
+		err = runTool(ctx, options, dir, "", options.DvipsCommand,
+			"-o", options.Jobname+".ps", options.Jobname+".dvi")
+		if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+			return result, err
+		}
+		if err != nil {
+			result.Log = readLog(logFile)
+			return result, err
+		}
+	}
+	if options.Optimize {
+		err = optimize(ctx, options, dir)
+		if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+			return result, err
+		}
+		if err != nil {
+			result.Log = readLog(logFile)
+			return result, err
+		}
+	}
+	if options.PDFA > 0 {
+		err = convertPDFA(ctx, options, dir)
+		if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+			return result, err
+		}
+		if err != nil {
+			result.Log = readLog(logFile)
+			return result, err
+		}
+	}
+	if !options.InfoDate.IsZero() || options.InfoProducer != "" {
+		if err = rewriteInfo(options, dir); err != nil {
+			result.Log = readLog(logFile)
+			return result, err
 		}
 	}
 
 	// Slurp the output.
-	output, err := ioutil.ReadFile(path.Join(dir, "gotex.pdf"))
+	result.Log = readLog(logFile)
+	result.Pages = logPages(result.Log)
+	result.Warnings = ParseLog(result.Log)
+	if options.SyncTeX {
+		result.SyncTeX, err = ioutil.ReadFile(path.Join(dir, options.Jobname+".synctex.gz"))
+		if err != nil {
+			return result, err
+		}
+	}
+	if options.ReturnAux {
+		result.Aux, err = readAux(options, dir)
+		if err != nil {
+			return result, err
+		}
+	}
+	var outFile = path.Join(dir, options.Jobname+options.OutputFormat.ext())
+	if result.Pages == 0 && options.OutputFormat == PDF {
+		if pdf, err := ioutil.ReadFile(outFile); err == nil {
+			result.Pages = pdfPages(pdf)
+		}
+	}
+	// Delivering it may move it, so grab it for the cache first.
+	var output []byte
+	if key != "" {
+		output, err = ioutil.ReadFile(outFile)
+		if err != nil {
+			return result, err
+		}
+	}
+	err = deliver(ctx, options, outFile)
+	if err := stopped(ctx, parent, options, &result, logFile); err != nil {
+		return result, err
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// Clean up the temp directory, unless the caller wants it.
+	if !options.KeepTemp {
+		logf(options, "gotex: removing %s", dir)
+		_ = os.RemoveAll(dir)
+		result.Dir = ""
+	}
+
+	// The output is fine as far as LaTeX is concerned, but the caller may not
+	// think so.
+	var fatal []Warning
+	for _, warning := range result.Warnings {
+		for _, kind := range options.FailOnWarnings {
+			if warning.Kind == kind {
+				fatal = append(fatal, warning)
+				break
+			}
+		}
+	}
+	if len(fatal) > 0 {
+		return result, &WarningError{Warnings: fatal}
+	}
+	if key != "" {
+		options.Cache.Put(key, output)
+	}
+	return result, nil
+}
+
+// source hands out the document for each LaTeX run. If file is set, LaTeX
+// reads the document from there instead, and r is nil. A relative file is in
+// the temporary directory.
+type source struct {
+	r     io.Reader
+	start int64
+	used  bool
+	file  string
+}
+
+// newSource prepares r to be read once for each LaTeX run. An io.Seeker is
+// rewound each time. Anything else is read into memory, unless there will
+// only be one run.
+func newSource(r io.Reader, runs int) (*source, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		var start, err = seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return &source{r: r, start: start}, nil
+		}
+	}
+	if runs == 1 {
+		return &source{r: r}, nil
+	}
+	var document, err = ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return &source{r: bytes.NewReader(document)}, nil
+}
 
-	// Clean up the temp directory.
-	_ = os.RemoveAll(dir)
-	return output, nil
+// next returns the document for the next run.
+func (s *source) next() (io.Reader, error) {
+	if s.file != "" {
+		return nil, nil
+	}
+	if s.used {
+		var _, err = s.r.(io.Seeker).Seek(s.start, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.used = true
+	return s.r, nil
 }
 
-// runLatex does the actual work of spawning the child and waiting for it.
-func runLatex(document string, options Options, dir string) error {
-	var args = []string{"-jobname=gotex", "-halt-on-error"}
+// stopped checks whether ctx is done. If so, it cleans up and returns the error
+// the render should fail with. parent is the context given by the caller, used
+// to tell Options.Timeout apart from the caller giving up.
+func stopped(ctx, parent context.Context, options Options, result *RenderResult, logFile string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	// A timeout is a failure of the document, so keep the log around for it.
+	if parent.Err() == nil {
+		result.Log = readLog(logFile)
+		return fmt.Errorf("%w. Check %s", ErrTimeout, logFile)
+	}
+	if !options.KeepTemp {
+		_ = os.RemoveAll(result.Dir)
+		result.Dir = ""
+	}
+	return fmt.Errorf("gotex: render aborted: %w", ctx.Err())
+}
 
-	// Prepare the command.
-	var cmd = exec.Command(options.Command, args...)
+// makeTempDir creates a temporary directory under base, or under the system
+// default if base is empty. The errors are more helpful than what TempDir
+// would give on its own.
+func makeTempDir(base string) (string, error) {
+	if base != "" {
+		var info, err = os.Stat(base)
+		if err != nil {
+			return "", fmt.Errorf("gotex: bad TempDir: %w", err)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("gotex: bad TempDir: %s is not a directory", base)
+		}
+	}
+	var dir, err = ioutil.TempDir(base, "gotex-")
+	if err != nil {
+		return "", fmt.Errorf("gotex: can't create temporary directory: %w", err)
+	}
+	return dir, nil
+}
+
+// checkJobname makes sure that a jobname can't escape the temporary directory
+// or be mangled on its way through a shell. LaTeX also stops reading a
+// -jobname argument at a space.
+func checkJobname(jobname string) error {
+	if jobname == "." || jobname == ".." ||
+		strings.ContainsAny(jobname, "/\\`$&;|<>()*?!~'\" \t\r\n") {
+		return fmt.Errorf("gotex: invalid Jobname %q", jobname)
+	}
+	return nil
+}
+
+// setDefaults fills in the defaults for any options left unset, and checks the
+// ones that were set.
+func setDefaults(options Options) (Options, error) {
+	if options.Engine == "" {
+		options.Engine = PdfLaTeX
+	}
+	if !options.Engine.known() {
+		return options, fmt.Errorf("gotex: unknown Engine %q", options.Engine)
+	}
+	// This also checks that the engine can produce the format at all.
+	var command, err = options.Engine.command(options.OutputFormat)
+	if err != nil {
+		return options, err
+	}
+	if options.Command == "" {
+		options.Command = command
+	}
+	if options.InteractionMode == "" {
+		options.InteractionMode = "halt-on-error"
+	}
+	switch options.InteractionMode {
+	case "halt-on-error", "nonstopmode", "batchmode", "scrollmode":
+	default:
+		return options, fmt.Errorf("gotex: unknown InteractionMode %q",
+			options.InteractionMode)
+	}
+	if options.Jobname == "" {
+		options.Jobname = "gotex"
+	}
+	if err := checkJobname(options.Jobname); err != nil {
+		return options, err
+	}
+	if options.BibEngine == "" && options.BibCommand != "" {
+		options.BibEngine = "bibtex"
+	}
+	if options.DvipsCommand == "" {
+		options.DvipsCommand = "dvips"
+	}
+	if options.MakeIndexCommand == "" {
+		options.MakeIndexCommand = "makeindex"
+	}
+	if options.GlossariesCommand == "" {
+		options.GlossariesCommand = "makeglossaries"
+	}
+	if options.GhostscriptCommand == "" {
+		options.GhostscriptCommand = "gs"
+	}
+	if options.OptimizeDPI == 0 {
+		options.OptimizeDPI = 150
+	}
+	if options.OptimizeDPI < 0 {
+		return options, fmt.Errorf("gotex: invalid OptimizeDPI %d", options.OptimizeDPI)
+	}
+	if options.Optimize && options.OutputFormat != PDF {
+		return options, fmt.Errorf("gotex: Optimize needs PDF output, not %v", options.OutputFormat)
+	}
+	if options.PDFA < 0 || options.PDFA > 3 {
+		return options, fmt.Errorf("gotex: unknown PDFA level %d", options.PDFA)
+	}
+	if options.PDFA > 0 && options.OutputFormat != PDF {
+		return options, fmt.Errorf("gotex: PDFA needs PDF output, not %v", options.OutputFormat)
+	}
+	if options.PDFA > 0 && options.PDFAProfile == "" {
+		return options, errors.New("gotex: PDFA needs PDFAProfile")
+	}
+	if !options.InfoDate.IsZero() || options.InfoProducer != "" {
+		if options.OutputFormat != PDF {
+			return options, fmt.Errorf("gotex: InfoDate and InfoProducer need PDF output, not %v",
+				options.OutputFormat)
+		}
+		if options.PDFA > 0 {
+			return options, errors.New("gotex: InfoDate and InfoProducer can't be used with PDFA")
+		}
+	}
+	// mylatexformat skips the preamble, and the Metadata with it.
+	if len(options.Format) > 0 && options.Metadata != (Metadata{}) {
+		return options, errors.New("gotex: Metadata can't be used with Format")
+	}
+	if options.LatexmkCommand == "" {
+		options.LatexmkCommand = "latexmk"
+	}
+	if options.RerunPatterns == nil {
+		options.RerunPatterns = DefaultRerunPatterns
+	}
+	if options.RerunFunc == nil {
+		options.RerunFunc = matchAny(options.RerunPatterns)
+	}
+	switch options.BibEngine {
+	case "", "none", "auto", "bibtex", "biber":
+	default:
+		return options, fmt.Errorf("gotex: unknown BibEngine %q", options.BibEngine)
+	}
+	return options, nil
+}
+
+// readLog returns the contents of the log file, or nil if LaTeX didn't get far
+// enough to write one.
+func readLog(logFile string) []byte {
+	var log, err = ioutil.ReadFile(logFile)
+	if err != nil {
+		return nil
+	}
+	return log
+}
+
+// logf passes a message to options.Logger, if there is one.
+func logf(options Options, format string, v ...interface{}) {
+	if options.Logger != nil {
+		options.Logger.Printf(format, v...)
+	}
+}
+
+// newCommand prepares a command to run in dir, with the environment given by
+// options. If ctx is done before the command exits, it is terminated.
+func newCommand(ctx context.Context, options Options, dir, name string, args ...string) *exec.Cmd {
+	logf(options, "gotex: running %s %s", name, strings.Join(args, " "))
+	var cmd = exec.CommandContext(ctx, name, args...)
+	// Give the child a chance to exit cleanly when the context is done, rather
+	// than the default of killing it immediately.
+	setCancel(cmd)
+	cmd.WaitDelay = killGracePeriod
 	// Set the cwd to the temporary directory; LaTeX will write all files there.
 	cmd.Dir = dir
-	// Feed the document to LaTeX over stdin.
-	cmd.Stdin = strings.NewReader(document)
+	cmd.Env = environ(options)
+	return cmd
+}
 
-	// Set $TEXINPUTS if requested. The trailing colon means that LaTeX should
-	// include the normal asset directories as well.
-	if options.Texinputs != "" {
-		cmd.Env = append(os.Environ(), "TEXINPUTS="+options.Texinputs+":")
+// runLatex does the actual work of spawning the child and waiting for it. If
+// ctx is done before the child exits, the child is terminated and reaped.
+// The child's stdout and stderr are captured and returned, even on failure.
+// If file is absolute, LaTeX compiles it from its own directory and writes its
+// output to dir. Otherwise, LaTeX runs in dir and compiles file from there, or
+// reads document from stdin if there isn't one.
+func runLatex(ctx context.Context, document io.Reader, file string, options Options, dir string) (stdout, stderr []byte, err error) {
+	var args = []string{"-jobname=" + options.Jobname}
+	// Halting on errors still needs nonstopmode so LaTeX doesn't prompt.
+	if options.InteractionMode == "halt-on-error" {
+		args = append(args, "-interaction=nonstopmode", "-halt-on-error")
+	} else {
+		args = append(args, "-interaction="+options.InteractionMode)
+	}
+	args = append(args, options.ShellEscape.arg())
+	if options.FileLineError {
+		args = append(args, "-file-line-error")
+	}
+	if options.SyncTeX {
+		args = append(args, "-synctex=1")
+	}
+	if len(options.Format) > 0 {
+		// This has to be absolute, since RenderFile runs LaTeX elsewhere.
+		var format, err = filepath.Abs(filepath.Join(dir, formatName))
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, "-fmt="+format)
+	}
+	// XeLaTeX normally converts its output to PDF on the fly.
+	if options.OutputFormat == XDV {
+		args = append(args, "-no-pdf")
+	}
+	args = append(args, options.ExtraArgs...)
+	var command = options.Command
+	if options.Latexmk {
+		// latexmk understands -jobname, the first argument, and
+		// -output-directory itself, but the rest have to be passed through
+		// to LaTeX.
+		var latexmkArgs = options.Engine.latexmk(options.OutputFormat, options.Command)
+		latexmkArgs = append(latexmkArgs, args[0])
+		for _, arg := range args[1:] {
+			latexmkArgs = append(latexmkArgs, "-latexoption="+arg)
+		}
+		args = latexmkArgs
+		command = options.LatexmkCommand
+	}
+	var cwd = dir
+	if file != "" && !filepath.IsAbs(file) {
+		args = append(args, file)
+	} else if file != "" {
+		// The output directory is relative to the cwd, which is changing.
+		var out, err = filepath.Abs(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		cwd = filepath.Dir(file)
+		args = append(args, "-output-directory="+out, filepath.Base(file))
+	}
+
+	// Prepare the command.
+	var cmd = newCommand(ctx, options, cwd, command, args...)
+	if options.DryRun {
+		return nil, nil, &DryRunError{Args: cmd.Args, Dir: cmd.Dir, Env: cmd.Env}
+	}
+	// Feed the document to LaTeX over stdin.
+	cmd.Stdin = document
+	// Some things, like \write18 output and engine crashes, never make it
+	// into the log, so hang onto the raw output too.
+	// Only the end is kept, since a runaway document can print forever.
+	var outBuf = &tailBuffer{max: maxOutput}
+	var errBuf = &tailBuffer{max: maxOutput}
+	cmd.Stdout = outBuf
+	cmd.Stderr = errBuf
+	if options.OnLogLine != nil {
+		var mu sync.Mutex
+		var outLines = &lineWriter{fn: options.OnLogLine, mu: &mu}
+		var errLines = &lineWriter{fn: options.OnLogLine, mu: &mu}
+		defer outLines.flush()
+		defer errLines.flush()
+		cmd.Stdout = io.MultiWriter(outBuf, outLines)
+		cmd.Stderr = io.MultiWriter(errBuf, errLines)
 	}
 
 	// Launch and let it finish.
-	var err = cmd.Start()
+	err = cmd.Start()
 	if err != nil {
-		return err
+		// There's no log to point at, so don't pretend it's a LaTeX error.
+		err = commandNotFound(err)
+		if errors.Is(err, ErrCommandNotFound) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("gotex: can't start LaTeX: %w", err)
 	}
 	err = cmd.Wait()
+	stdout, stderr = outBuf.Bytes(), errBuf.Bytes()
 	if err != nil {
-		// The actual error is useless, do provide a better one.
-		return errors.New("LaTeX error. Check " + path.Join(dir, "gotex.log"))
+		// The exit status alone says little, so explain it from the log.
+		var latexErr = newLatexError(dir, path.Join(dir, options.Jobname+".log"))
+		latexErr.Stdout, latexErr.Stderr = stdout, stderr
+		latexErr.ExitCode = exitCode(err)
+		latexErr.Err = err
+		return stdout, stderr, latexErr
+	}
+	return stdout, stderr, nil
+}
+
+// auxSum returns a hash of the aux file in dir, and false if there isn't one.
+func auxSum(options Options, dir string) ([sha256.Size]byte, bool) {
+	var aux, err = ioutil.ReadFile(path.Join(dir, options.Jobname+".aux"))
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(aux), true
+}
+
+// matchAny returns a function that reports whether a line contains any of
+// patterns, ignoring case.
+func matchAny(patterns []string) func(line string) bool {
+	var lower = make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lower[i] = strings.ToLower(pattern)
+	}
+	return func(line string) bool {
+		line = strings.ToLower(line)
+		for _, pattern := range lower {
+			if strings.Contains(line, pattern) {
+				return true
+			}
+		}
+		return false
 	}
-	return nil
 }
 
 // Parse the log file and attempt to determine whether another run is necessary
 // to finish the document.
-func needsRerun(dir string) bool {
-	var file, err = os.Open(path.Join(dir, "gotex.log"))
+func needsRerun(logFile string, match func(line string) bool) bool {
+	var file, err = os.Open(logFile)
 	if err != nil {
 		return false
 	}
@@ -150,7 +1350,7 @@ func needsRerun(dir string) bool {
 	for scanner.Scan() {
 		// Look for a line like:
 		// "Label(s) may have changed. Rerun to get cross-references right."
-		if strings.Contains(scanner.Text(), "Rerun to get") {
+		if match(scanner.Text()) {
 			return true
 		}
 	}
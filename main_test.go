@@ -4,7 +4,25 @@
 package gotex
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestRender(t *testing.T) {
@@ -31,3 +49,1872 @@ func TestRender(t *testing.T) {
 		t.Error("Should not product a PDF on invalid document")
 	}
 }
+
+// fakeLatex writes a shell script that stands in for the LaTeX command and
+// returns its path.
+func fakeLatex(t *testing.T, script string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake LaTeX commands need a POSIX shell")
+	}
+	var name = filepath.Join(t.TempDir(), "fakelatex")
+	var err = ioutil.WriteFile(name, []byte("#!/bin/sh\n"+script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestRenderContextCancel(t *testing.T) {
+	var command = fakeLatex(t, "exec sleep 10\n")
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var start = time.Now()
+	var pdf, err = RenderContext(ctx, "", Options{Command: command})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Should return the context error, got", err)
+	}
+	if pdf != nil {
+		t.Error("Should not produce a PDF when cancelled")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("LaTeX process was not killed on cancel")
+	}
+}
+
+func TestRenderContextCancelled(t *testing.T) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var _, err = RenderContext(ctx, "", Options{Command: "/nonexistent/pdflatex"})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("Should not run anything with a cancelled context, got", err)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	// Ignore SIGTERM to make sure the grace period ends in a kill.
+	var command = fakeLatex(t, "trap '' TERM\nsleep 10\n")
+	var _, err = Render("", Options{Command: command, TempDir: t.TempDir(),
+		Timeout: 100 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("Should return ErrTimeout, got", err)
+	}
+}
+
+func TestRenderNoPrompt(t *testing.T) {
+	// LaTeX would normally stop and prompt on the undefined control sequence.
+	var document = `
+        \documentclass{article}
+        \begin{document}
+        \undefinedcontrolsequence
+        \end{document}
+        `
+	var _, err = Render(document, Options{Timeout: time.Minute})
+	if err == nil {
+		t.Error("Should fail on undefined control sequence")
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Error("LaTeX blocked waiting for input")
+	}
+}
+
+func TestRenderFull(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "This is a fake LaTeX log." >gotex.log
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Pdf) != "%PDF-1.5\n" {
+		t.Errorf("Wrong PDF %q", result.Pdf)
+	}
+	if string(result.Log) != "This is a fake LaTeX log.\n" {
+		t.Errorf("Wrong log %q", result.Log)
+	}
+	if result.Runs != 1 {
+		t.Error("Should have run once, ran", result.Runs)
+	}
+
+	// The log should be returned on failure too.
+	command = fakeLatex(t, `echo "! Undefined control sequence." >gotex.log
+echo "Segmentation fault" >&2
+exit 1
+`)
+	result, err = RenderFull("", Options{Command: command, TempDir: t.TempDir()})
+	if err == nil {
+		t.Error("Should fail when LaTeX fails")
+	}
+	if string(result.Log) != "! Undefined control sequence.\n" {
+		t.Errorf("Wrong log %q", result.Log)
+	}
+	var latexErr *LatexError
+	if !errors.As(err, &latexErr) {
+		t.Fatal("Should return a LatexError, got", err)
+	}
+	if latexErr.Message != "Undefined control sequence." {
+		t.Errorf("Wrong message %q", latexErr.Message)
+	}
+	if latexErr.Tail != "! Undefined control sequence." {
+		t.Errorf("Wrong tail %q", latexErr.Tail)
+	}
+	if string(latexErr.Stderr) != "Segmentation fault\n" {
+		t.Errorf("Wrong stderr %q", latexErr.Stderr)
+	}
+}
+
+func TestRenderKeepTemp(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Dir != "" {
+		t.Error("Should not report a removed directory", result.Dir)
+	}
+
+	result, err = RenderFull("", Options{Command: command, KeepTemp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(result.Dir)
+	if _, err = os.Stat(filepath.Join(result.Dir, "gotex.pdf")); err != nil {
+		t.Error("Should keep the temporary directory", err)
+	}
+}
+
+func TestRenderTempDir(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var base = t.TempDir()
+	var result, err = RenderFull("", Options{Command: command, TempDir: base, KeepTemp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(result.Dir) != base {
+		t.Error("Should render inside TempDir, rendered in", result.Dir)
+	}
+
+	_, err = Render("", Options{Command: command, TempDir: filepath.Join(base, "missing")})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("Should fail on a missing TempDir, got", err)
+	}
+}
+
+func TestRenderJobname(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+# Mimic LaTeX naming its output after the jobname.
+jobname=${1#-jobname=}
+echo "%PDF-1.5" >"$jobname.pdf"
+echo "log" >"$jobname.log"
+`)
+	var result, err = RenderFull("", Options{Command: command, Jobname: "invoice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Pdf) != "%PDF-1.5\n" || string(result.Log) != "log\n" {
+		t.Error("Should read the output named after the jobname")
+	}
+	var outPath = filepath.Join(t.TempDir(), "2017-invoice.pdf")
+	err = RenderToFile(outPath, "", Options{Command: command, Jobname: "invoice"})
+	if pdf, _ := ioutil.ReadFile(outPath); err != nil || string(pdf) != "%PDF-1.5\n" {
+		t.Errorf("Should write the output under its own name, got %q, %v", pdf, err)
+	}
+
+	for _, jobname := range []string{"../evil", "a/b", `a\b`, "a;rm", "$HOME", "my job", "..", "tab\tname"} {
+		_, err = Render("", Options{Command: command, Jobname: jobname})
+		if err == nil {
+			t.Errorf("Should reject jobname %q", jobname)
+		}
+	}
+}
+
+func TestRenderFiles(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+cat style/corporate.sty >gotex.pdf
+`)
+	var files = map[string][]byte{"style/corporate.sty": []byte("%PDF-1.5\n")}
+	var pdf, err = Render("", Options{Command: command, Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "%PDF-1.5\n" {
+		t.Error("Should write Files into the temporary directory")
+	}
+
+	for _, name := range []string{"", "/etc/passwd", "../evil", "a/../../evil"} {
+		var files = map[string][]byte{name: nil}
+		_, err = Render("", Options{Command: command, Files: files})
+		if err == nil {
+			t.Errorf("Should reject filename %q", name)
+		}
+	}
+}
+
+func TestEnvironTexinputs(t *testing.T) {
+	if env := environ(Options{}); env != nil {
+		t.Error("Should leave the environment alone by default")
+	}
+
+	var env = environ(Options{Texinputs: "/a", TexinputsDirs: []string{"/b", "/c"}})
+	var sep = string(os.PathListSeparator)
+	var want = "TEXINPUTS=/a" + sep + "/b" + sep + "/c" + sep
+	if len(env) == 0 || env[len(env)-1] != want {
+		t.Errorf("Wrong environment, want %q in %q", want, env)
+	}
+	if len(env) != len(os.Environ())+1 {
+		t.Error("Should inherit the parent environment")
+	}
+
+	env = environ(Options{
+		ClearEnv:      true,
+		TexinputsDirs: []string{"/a"},
+		Env:           map[string]string{"TEXINPUTS": "/b" + sep},
+	})
+	want = "TEXINPUTS=/a" + sep + "/b" + sep
+	if len(env) != 1 || env[0] != want {
+		t.Errorf("Should combine TexinputsDirs with Env, want %q, got %q", want, env)
+	}
+}
+
+func TestEnvironFontDirs(t *testing.T) {
+	var sep = string(os.PathListSeparator)
+	var env = environ(Options{
+		ClearEnv: true,
+		FontDirs: []string{"/fonts/a", "/fonts/b"},
+		Env:      map[string]string{"OSFONTDIR": "/usr/share/fonts"},
+	})
+	var want = []string{
+		"OSFONTDIR=/fonts/a" + sep + "/fonts/b" + sep + "/usr/share/fonts",
+		"OPENTYPEFONTS=/fonts/a" + sep + "/fonts/b" + sep,
+		"TTFONTS=/fonts/a" + sep + "/fonts/b" + sep,
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("Wrong font environment, want %q, got %q", want, env)
+	}
+}
+
+func TestRenderFS(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+cat template/a.tex template/b.tex >gotex.pdf
+`)
+	var fsys = fstest.MapFS{
+		"template/a.tex": {Data: []byte("a\n")},
+		"template/b.tex": {Data: []byte("overwritten\n")},
+		"template/link":  {Data: []byte("/etc/passwd"), Mode: fs.ModeSymlink},
+	}
+	var files = map[string][]byte{"template/b.tex": []byte("b\n")}
+	var result, err = RenderFull("", Options{Command: command, FS: fsys, Files: files, KeepTemp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(result.Dir)
+	if string(result.Pdf) != "a\nb\n" {
+		t.Errorf("Should copy FS and then Files, got %q", result.Pdf)
+	}
+	if _, err = os.Lstat(filepath.Join(result.Dir, "template", "link")); err == nil {
+		t.Error("Should skip symlinks")
+	}
+}
+
+func TestRenderBibtex(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+printf '%s\n' '\citation{knuth}' '\bibdata{refs}' >gotex.aux
+if [ -f gotex.bbl ]; then cp gotex.bbl gotex.pdf; else echo "[?]" >gotex.pdf; fi
+`)
+	var bibtex = fakeLatex(t, `echo "Knuth" >"$1.bbl"
+exit 1
+`)
+	var result, err = RenderFull("", Options{Command: command, BibCommand: bibtex})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Pdf) != "Knuth\n" {
+		t.Errorf("Should resolve the citation, got %q", result.Pdf)
+	}
+	if result.Runs != 3 {
+		t.Error("Should run LaTeX twice after BibTeX, ran", result.Runs)
+	}
+
+	bibtex = fakeLatex(t, "exit 2\n")
+	_, err = Render("", Options{Command: command, BibCommand: bibtex, TempDir: t.TempDir()})
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) || toolErr.ExitCode != 2 {
+		t.Error("Should return a ToolError when BibTeX fails, got", err)
+	}
+}
+
+func TestRenderBiber(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "control" >gotex.bcf
+if [ -f gotex.bbl ]; then cp gotex.bbl gotex.pdf; else echo "[?]" >gotex.pdf; fi
+`)
+	var biber = fakeLatex(t, `echo "Knuth" >"$1.bbl"
+`)
+	var pdf, err = Render("", Options{Command: command, BibEngine: "biber", BibCommand: biber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "Knuth\n" {
+		t.Errorf("Should resolve the citation, got %q", pdf)
+	}
+	var result RenderResult
+	result, err = RenderFull("", Options{Command: command, BibEngine: "none", BibCommand: biber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Pdf) != "[?]\n" || result.BibLog != nil {
+		t.Error("Should not run biber with BibEngine none")
+	}
+
+	biber = fakeLatex(t, `echo "ERROR - Cannot find 'refs.bib'!" >"$1.blg"
+exit 2
+`)
+	_, err = Render("", Options{Command: command, BibEngine: "biber", BibCommand: biber,
+		TempDir: t.TempDir()})
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Fatal("Should return a ToolError when biber fails, got", err)
+	}
+	if string(toolErr.Log) != "ERROR - Cannot find 'refs.bib'!\n" {
+		t.Errorf("Should return the biber log, got %q", toolErr.Log)
+	}
+}
+
+func TestRenderBibliography(t *testing.T) {
+	var document = `
+        \documentclass{article}
+        \begin{document}
+        As shown by \cite{knuth}.
+        \bibliographystyle{plain}
+        \bibliography{refs}
+        \end{document}
+        `
+	var files = map[string][]byte{"refs.bib": []byte(`
+        @book{knuth,
+            author = {Donald E. Knuth},
+            title = {The {\TeX}book},
+            publisher = {Addison-Wesley},
+            year = {1984}
+        }
+        `)}
+	var result, err = RenderFull(document, Options{BibEngine: "bibtex", Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(result.Log, []byte("undefined")) {
+		t.Error("Citation was not resolved")
+	}
+}
+
+func TestBibEngineAuto(t *testing.T) {
+	var dir = t.TempDir()
+	var options = Options{Jobname: "gotex", BibEngine: "auto"}
+	if engine := bibEngine(options, dir); engine != "" {
+		t.Error("Should not need a bibliography tool, got", engine)
+	}
+	var aux = []byte("\\citation{knuth}\n\\bibdata{refs}\n")
+	var err = ioutil.WriteFile(filepath.Join(dir, "gotex.aux"), aux, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engine := bibEngine(options, dir); engine != "bibtex" {
+		t.Error("Should detect BibTeX, got", engine)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "gotex.bcf"), nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if engine := bibEngine(options, dir); engine != "biber" {
+		t.Error("Should detect biber, got", engine)
+	}
+}
+
+func TestRenderMakeIndex(t *testing.T) {
+	// The index entry moves to page 2 once the index itself is typeset.
+	var command = fakeLatex(t, `cat >/dev/null
+if [ -f gotex.ind ]; then echo "page 2" >gotex.idx; else echo "page 1" >gotex.idx; fi
+cp gotex.idx gotex.pdf
+`)
+	var makeindex = fakeLatex(t, `echo "$1" >>args
+cp gotex.idx gotex.ind
+`)
+	var options = Options{
+		Command:          command,
+		MakeIndex:        true,
+		MakeIndexCommand: makeindex,
+		MakeIndexArgs:    []string{"-q"},
+		KeepTemp:         true,
+	}
+	var result, err = RenderFull("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(result.Dir)
+	if string(result.Pdf) != "page 2\n" {
+		t.Errorf("Should index the final page numbers, got %q", result.Pdf)
+	}
+	if result.Runs != 3 {
+		t.Error("Should run LaTeX until the index settles, ran", result.Runs)
+	}
+	var args, _ = ioutil.ReadFile(filepath.Join(result.Dir, "args"))
+	if string(args) != "-q\n-q\n" {
+		t.Errorf("Should pass MakeIndexArgs, got %q", args)
+	}
+
+	options.MakeIndexCommand = fakeLatex(t, "exit 1\n")
+	options.TempDir = t.TempDir()
+	_, err = Render("", options)
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Error("Should return a ToolError when makeindex fails, got", err)
+	}
+}
+
+func TestRenderGlossaries(t *testing.T) {
+	// The glossary only exists once makeglossaries has sorted it.
+	var command = fakeLatex(t, `cat >/dev/null
+echo "entry" >gotex.glo
+if [ -f gotex.gls ]; then cp gotex.gls gotex.pdf; else echo "empty" >gotex.pdf; fi
+`)
+	var makeglossaries = fakeLatex(t, `echo "$1" >>args
+sed 's/^/sorted /' gotex.glo >gotex.gls
+`)
+	var options = Options{
+		Command:           command,
+		Glossaries:        true,
+		GlossariesCommand: makeglossaries,
+		KeepTemp:          true,
+	}
+	var result, err = RenderFull("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(result.Dir)
+	if string(result.Pdf) != "sorted entry\n" {
+		t.Errorf("Should typeset the sorted glossary, got %q", result.Pdf)
+	}
+	if result.Runs != 2 {
+		t.Error("Should run LaTeX again after makeglossaries, ran", result.Runs)
+	}
+	var args, _ = ioutil.ReadFile(filepath.Join(result.Dir, "args"))
+	if string(args) != "gotex\n" {
+		t.Errorf("Should run makeglossaries once on the jobname, got %q", args)
+	}
+
+	options.GlossariesCommand = fakeLatex(t, "exit 1\n")
+	options.TempDir = t.TempDir()
+	_, err = Render("", options)
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Error("Should return a ToolError when makeglossaries fails, got", err)
+	}
+}
+
+func TestRenderLatexmk(t *testing.T) {
+	var latexmk = fakeLatex(t, `for arg; do echo "$arg"; done >gotex.pdf
+`)
+	var bibtex = fakeLatex(t, "exit 1\n")
+	var result, err = RenderFull("doc", Options{Latexmk: true, LatexmkCommand: latexmk,
+		Command: "/opt/pdflatex", BibEngine: "bibtex", BibCommand: bibtex,
+		ExtraArgs: []string{"-8bit"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = "-pdf\n-pdflatex=/opt/pdflatex %O %S\n-jobname=gotex\n" +
+		"-latexoption=-interaction=nonstopmode\n-latexoption=-halt-on-error\n" +
+		"-latexoption=-no-shell-escape\n-latexoption=-8bit\ngotex.tex\n"
+	if string(result.Pdf) != want {
+		t.Errorf("Should run latexmk on the document file, got %q", result.Pdf)
+	}
+	if result.Runs != 1 {
+		t.Error("Should leave the passes to latexmk, ran", result.Runs)
+	}
+
+	var tests = map[string]struct {
+		engine Engine
+		format OutputFormat
+		want   []string
+	}{
+		"xelatex":  {XeLaTeX, PDF, []string{"-pdfxe", "-xelatex=x %O %S"}},
+		"lualatex": {LuaLaTeX, PDF, []string{"-pdflua", "-lualatex=x %O %S"}},
+		"dvi":      {PdfLaTeX, DVI, []string{"-dvi", "-latex=x %O %S"}},
+		"ps":       {LuaLaTeX, PS, []string{"-dvilua", "-dvilualatex=x %O %S", "-ps"}},
+		"xdv":      {XeLaTeX, XDV, []string{"-xdv", "-xelatex=x %O %S"}},
+	}
+	for name, test := range tests {
+		if args := test.engine.latexmk(test.format, "x"); !reflect.DeepEqual(args, test.want) {
+			t.Errorf("%s: wrong latexmk arguments %q", name, args)
+		}
+	}
+}
+
+func TestRenderSyncTeX(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "$@" >gotex.pdf
+echo "synctex" >gotex.synctex.gz
+`)
+	var result, err = RenderFull("", Options{Command: command, SyncTeX: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(result.Pdf, []byte("-synctex=1")) {
+		t.Errorf("Should pass -synctex=1, got %q", result.Pdf)
+	}
+	if string(result.SyncTeX) != "synctex\n" {
+		t.Errorf("Should return the SyncTeX file, got %q", result.SyncTeX)
+	}
+
+	result, err = RenderFull("", Options{Command: command})
+	if err != nil || result.SyncTeX != nil || bytes.Contains(result.Pdf, []byte("synctex")) {
+		t.Errorf("Should leave SyncTeX off by default, got %q, %q, %v", result.Pdf, result.SyncTeX, err)
+	}
+}
+
+func TestRenderReturnAux(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "log" >gotex.log
+echo "aux" >gotex.aux
+echo "toc" >gotex.toc
+echo "other" >other.aux
+mkdir gotex.d
+`)
+	var result, err = RenderFull("", Options{Command: command, ReturnAux: true,
+		WriteSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = map[string][]byte{"gotex.aux": []byte("aux\n"), "gotex.toc": []byte("toc\n")}
+	if !reflect.DeepEqual(result.Aux, want) {
+		t.Errorf("Should return the jobname's auxiliary files, got %q", result.Aux)
+	}
+
+	result, err = RenderFull("", Options{Command: command})
+	if err != nil || result.Aux != nil {
+		t.Errorf("Should only return auxiliary files when asked, got %q, %v", result.Aux, err)
+	}
+}
+
+func TestRenderAux(t *testing.T) {
+	// The aux file only changes if there isn't one yet.
+	var command = fakeLatex(t, `cat >/dev/null
+[ -f gotex.aux ] || printf '%s\n' '\citation{x}' '\bibdata{y}' >gotex.aux
+echo "Rerun to get cross-references right." >gotex.log
+cat gotex.aux >gotex.pdf
+`)
+	var options = Options{Command: command, BibEngine: "bibtex",
+		BibCommand: fakeLatex(t, "exit 2\n"),
+		Aux: map[string][]byte{
+			"gotex.aux": []byte("\\citation{x}\n\\bibdata{y}\n"),
+			"gotex.bbl": []byte("bbl\n"),
+		}}
+	var result, err = RenderFull("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Runs != 1 {
+		t.Error("Should settle in one run with unchanged aux files, ran", result.Runs)
+	}
+
+	options.Aux = nil
+	options.TempDir = t.TempDir()
+	_, err = Render("", options)
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Error("Should run BibTeX without the earlier .bbl, got", err)
+	}
+}
+
+func TestRenderArgs(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "$@" >gotex.pdf
+`)
+	var tests = map[string]string{
+		"":            "-jobname=gotex -interaction=nonstopmode -halt-on-error -no-shell-escape\n",
+		"nonstopmode": "-jobname=gotex -interaction=nonstopmode -no-shell-escape\n",
+		"batchmode":   "-jobname=gotex -interaction=batchmode -no-shell-escape\n",
+	}
+	for mode, want := range tests {
+		var pdf, err = Render("", Options{Command: command, InteractionMode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pdf) != want {
+			t.Errorf("Wrong arguments for %q: %q", mode, pdf)
+		}
+	}
+
+	var _, err = Render("", Options{Command: command, InteractionMode: "errorstopmode"})
+	if err == nil {
+		t.Error("Should reject errorstopmode")
+	}
+
+	pdf, err := Render("", Options{Command: command, ShellEscape: ShellEscapeRestricted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "-jobname=gotex -interaction=nonstopmode -halt-on-error -shell-restricted\n" {
+		t.Errorf("Should restrict shell escape, got %q", pdf)
+	}
+
+	pdf, err = Render("", Options{Command: command, ExtraArgs: []string{"-synctex=1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "-jobname=gotex -interaction=nonstopmode -halt-on-error -no-shell-escape -synctex=1\n" {
+		t.Errorf("Should append ExtraArgs, got %q", pdf)
+	}
+
+	pdf, err = Render("", Options{Command: command, FileLineError: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "-jobname=gotex -interaction=nonstopmode -halt-on-error -no-shell-escape -file-line-error\n" {
+		t.Errorf("Should ask for file:line errors, got %q", pdf)
+	}
+}
+
+func TestRenderEngine(t *testing.T) {
+	// The engine's name is only used when Command isn't set, so put a fake
+	// xelatex on $PATH.
+	var command = fakeLatex(t, `cat >/dev/null
+basename "$0" >gotex.pdf
+`)
+	var bin = filepath.Join(filepath.Dir(command), "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(command, filepath.Join(bin, "xelatex")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	var pdf, err = Render("", Options{Engine: XeLaTeX})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "xelatex\n" {
+		t.Errorf("Should run xelatex, ran %q", pdf)
+	}
+
+	_, err = Render("", Options{Engine: "context"})
+	if err == nil {
+		t.Error("Should reject unknown engines")
+	}
+}
+
+func TestEngineCommand(t *testing.T) {
+	var tests = []struct {
+		engine  Engine
+		format  OutputFormat
+		command string
+	}{
+		{PdfLaTeX, PDF, "pdflatex"},
+		{PdfLaTeX, DVI, "latex"},
+		{LuaLaTeX, DVI, "dvilualatex"},
+		{XeLaTeX, PDF, "xelatex"},
+		{XeLaTeX, DVI, ""},
+		{XeLaTeX, XDV, "xelatex"},
+		{PdfLaTeX, XDV, ""},
+		{PdfLaTeX, PS, "latex"},
+		{XeLaTeX, PS, ""},
+		{PdfLaTeX, OutputFormat(42), ""},
+		{LaTeX, DVI, "latex"},
+		{LaTeX, PS, "latex"},
+		{LaTeX, PDF, ""},
+		{LaTeX, XDV, ""},
+	}
+	for _, test := range tests {
+		var command, err = test.engine.command(test.format)
+		if command != test.command || (err != nil) != (test.command == "") {
+			t.Errorf("Wrong command for %s and %v: %q, %v",
+				test.engine, test.format, command, err)
+		}
+	}
+}
+
+func TestRenderDVI(t *testing.T) {
+	var document = `
+        \documentclass{article}
+        \begin{document}
+        This is a DVI document.
+        \end{document}
+        `
+	var dvi, err = Render(document, Options{OutputFormat: DVI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// DVI files start with the pre opcode and format version 2.
+	if len(dvi) < 2 || dvi[0] != 0xf7 || dvi[1] != 2 {
+		t.Error("Generated file is not a DVI file")
+	}
+}
+
+func TestEnvironEnv(t *testing.T) {
+	t.Setenv("GOTEX_TEST", "parent")
+	var env = environ(Options{Env: map[string]string{"GOTEX_TEST": "child", "B": "2"}})
+	var found int
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "GOTEX_TEST=") {
+			found++
+			if kv != "GOTEX_TEST=child" {
+				t.Error("Env should override the parent environment, got", kv)
+			}
+		}
+	}
+	if found != 1 {
+		t.Error("Should set GOTEX_TEST exactly once, found", found)
+	}
+
+	env = environ(Options{ClearEnv: true, Env: map[string]string{"B": "2", "A": "1"}})
+	if strings.Join(env, " ") != "A=1 B=2" {
+		t.Errorf("Should only have Env with ClearEnv, got %q", env)
+	}
+	if env = environ(Options{ClearEnv: true}); env == nil || len(env) != 0 {
+		t.Errorf("Should have an empty environment with ClearEnv, got %q", env)
+	}
+}
+
+func TestRenderPS(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "dvi" >gotex.dvi
+`)
+	var dvips = fakeLatex(t, `[ "$1" = -o ] && cp "$3" "$2"
+`)
+	var ps, err = Render("", Options{Command: command, OutputFormat: PS, DvipsCommand: dvips})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(ps) != "dvi\n" {
+		t.Errorf("Should convert the DVI output with dvips, got %q", ps)
+	}
+}
+
+func TestRenderTo(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var output bytes.Buffer
+	var n, err = RenderTo(&output, "", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(output.Len()) {
+		t.Error("Wrong byte count", n)
+	}
+	if output.String() != "%PDF-1.5\n" {
+		t.Errorf("Should write the PDF, got %q", output.String())
+	}
+}
+
+func TestRenderToFile(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var outPath = filepath.Join(t.TempDir(), "reports", "report.pdf")
+	var err = RenderToFile(outPath, "", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pdf, _ = ioutil.ReadFile(outPath)
+	if string(pdf) != "%PDF-1.5\n" {
+		t.Errorf("Should write the PDF to outPath, got %q", pdf)
+	}
+
+	// A failed render must not touch outPath.
+	command = fakeLatex(t, "exit 1\n")
+	err = RenderToFile(outPath, "", Options{Command: command, TempDir: t.TempDir()})
+	if err == nil {
+		t.Error("Should fail when LaTeX fails")
+	}
+	pdf, _ = ioutil.ReadFile(outPath)
+	if string(pdf) != "%PDF-1.5\n" {
+		t.Errorf("Should leave outPath alone on failure, got %q", pdf)
+	}
+}
+
+func TestRenderSVG(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "dvi" >gotex.dvi
+`)
+	// Pretend the document has 10 pages, to check they come back in order.
+	var dvisvgm = fakeLatex(t, `for i in 1 2 3 4 5 6 7 8 9 10; do echo "$i" >gotex-page-$i.svg; done
+`)
+	var pages, err = RenderSVG("", Options{Command: command, DvisvgmCommand: dvisvgm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 10 {
+		t.Fatal("Should return one SVG per page, got", len(pages))
+	}
+	for i, page := range pages {
+		if string(page) != strconv.Itoa(i+1)+"\n" {
+			t.Errorf("Page %d is out of order: %q", i+1, page)
+		}
+	}
+}
+
+func TestRenderKeepTempCancelled(t *testing.T) {
+	var command = fakeLatex(t, "exec sleep 10\n")
+	var base = t.TempDir()
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var _, err = RenderContext(ctx, "", Options{Command: command, TempDir: base, KeepTemp: true})
+	if err == nil {
+		t.Fatal("Should fail when cancelled")
+	}
+	var dirs, _ = filepath.Glob(filepath.Join(base, "gotex-*"))
+	if len(dirs) != 1 {
+		t.Error("Should keep the temporary directory when cancelled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = RenderContext(ctx, "", Options{Command: command, TempDir: base})
+	if err == nil {
+		t.Fatal("Should fail when cancelled")
+	}
+	dirs, _ = filepath.Glob(filepath.Join(base, "gotex-*"))
+	if len(dirs) != 1 {
+		t.Error("Should remove the temporary directory when cancelled")
+	}
+}
+
+func TestRenderImage(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var pdftoppm = fakeLatex(t, `[ "$1 $2 $3 $4 $5" = "-png -r 72 gotex.pdf page" ] || exit 1
+echo 1 >page-01.png
+echo 2 >page-02.png
+`)
+	var pages, err = RenderImage("", Options{Command: command, PdftoppmCommand: pdftoppm}, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || string(pages[0]) != "1\n" || string(pages[1]) != "2\n" {
+		t.Errorf("Should return one PNG per page, got %q", pages)
+	}
+
+	_, err = RenderImage("", Options{Command: command, PdftoppmCommand: "/nonexistent/pdftoppm"}, 72)
+	if !errors.Is(err, os.ErrNotExist) || !errors.Is(err, ErrCommandNotFound) {
+		t.Error("Should fail clearly without a rasterizer, got", err)
+	}
+}
+
+func TestRenderReader(t *testing.T) {
+	// Each run appends what it read, so every run must see the whole document.
+	var command = fakeLatex(t, `cat >>gotex.pdf
+`)
+	// Hide the Seek method of the strings.Reader.
+	var r = struct{ io.Reader }{strings.NewReader("doc\n")}
+	var pdf, err = RenderReader(r, Options{Command: command, Runs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "doc\ndoc\n" {
+		t.Errorf("Should feed the document to every run, got %q", pdf)
+	}
+
+	var seeker = strings.NewReader("skip doc\n")
+	seeker.Seek(5, io.SeekStart)
+	pdf, err = RenderReader(seeker, Options{Command: command, Runs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "doc\ndoc\n" {
+		t.Errorf("Should rewind to where the reader started, got %q", pdf)
+	}
+}
+
+func TestRenderOnRun(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var runs, totals []int
+	var onRun = func(run, total int) {
+		runs = append(runs, run)
+		totals = append(totals, total)
+	}
+	var _, err = Render("", Options{Command: command, Runs: 3, OnRun: onRun})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 || runs[0] != 1 || runs[2] != 3 {
+		t.Error("Should call OnRun before each run, got", runs)
+	}
+	if totals[0] != 3 {
+		t.Error("Should pass Runs as the total, got", totals)
+	}
+
+	// Automagic mode only knows the limit.
+	runs, totals = nil, nil
+	_, err = Render("", Options{Command: command, MaxRuns: 7, OnRun: onRun})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || totals[0] != 7 {
+		t.Errorf("Should pass MaxRuns as the total, got %v of %v", runs, totals)
+	}
+}
+
+func TestRenderWith(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+cat extra.tex >gotex.pdf
+`)
+	var pdf, err = RenderWith("",
+		WithCommand(command),
+		WithRuns(1),
+		WithFile("extra.tex", []byte("extra\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "extra\n" {
+		t.Errorf("Should apply the options, got %q", pdf)
+	}
+}
+
+func TestRenderConverged(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "Label(s) may have changed. Rerun to get cross-references right." >gotex.log
+`)
+	var result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converged || result.Runs != 5 {
+		t.Errorf("Should hit the run limit without converging, ran %d", result.Runs)
+	}
+	result, err = RenderFull("", Options{Command: command, MaxRuns: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Runs != 8 {
+		t.Errorf("Should respect MaxRuns, ran %d", result.Runs)
+	}
+
+	command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+`)
+	result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Converged || result.Runs != 1 {
+		t.Errorf("Should converge after one run, ran %d", result.Runs)
+	}
+
+	// A fixed number of runs can be too few.
+	command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "Rerun to get cross-references right." >gotex.log
+`)
+	result, err = RenderFull("", Options{Command: command, Runs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converged {
+		t.Error("Should not converge with too few fixed runs")
+	}
+
+	// Asking for a rerun without changing the aux file won't ever settle.
+	command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo relax >gotex.aux
+echo "Rerun to get cross-references right." >gotex.log
+`)
+	result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converged || !result.Stalled || result.Runs != 2 {
+		t.Errorf("Should stop once the aux file settles, ran %d", result.Runs)
+	}
+	result, err = RenderFull("", Options{Command: command, Runs: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converged || result.Stalled || result.Runs != 3 {
+		t.Errorf("Should not call a fixed number of runs stalled, ran %d", result.Runs)
+	}
+
+	// As long as the aux file is changing, keep going.
+	command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo x >>gotex.aux
+echo "Rerun to get cross-references right." >gotex.log
+`)
+	result, err = RenderFull("", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Converged || result.Stalled || result.Runs != 5 {
+		t.Errorf("Should run to the limit while the aux file changes, ran %d", result.Runs)
+	}
+}
+
+func TestNeedsRerun(t *testing.T) {
+	var logFile = filepath.Join(t.TempDir(), "gotex.log")
+	var tests = []struct {
+		log      string
+		patterns []string
+		want     bool
+	}{
+		{"Label(s) may have changed. Rerun to get cross-references right.", DefaultRerunPatterns, true},
+		{"Package biblatex Warning: Please rerun LaTeX.", DefaultRerunPatterns, true},
+		{"Package biblatex Warning: Please (re)run Biber on the file:", DefaultRerunPatterns, true},
+		{"LaTeX Warning: There were undefined references.", DefaultRerunPatterns, false},
+		{"Output written on gotex.pdf (1 page, 1234 bytes).", DefaultRerunPatterns, false},
+		{"PLEASE RERUN LATEX", DefaultRerunPatterns, true},
+		{"Rerun to get cross-references right.", []string{"something else"}, false},
+		{"Package foo Warning: run me again", []string{"Run me again"}, true},
+	}
+	for _, test := range tests {
+		if err := ioutil.WriteFile(logFile, []byte("This is pdfTeX\n"+test.log+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := needsRerun(logFile, matchAny(test.patterns)); got != test.want {
+			t.Errorf("needsRerun(%q, %q) = %v, want %v", test.log, test.patterns, got, test.want)
+		}
+	}
+
+	// A custom function sees every line.
+	var lines []string
+	needsRerun(logFile, func(line string) bool {
+		lines = append(lines, line)
+		return false
+	})
+	if len(lines) != 2 || lines[0] != "This is pdfTeX" {
+		t.Errorf("RerunFunc should see each line, got %q", lines)
+	}
+}
+
+func TestRunLatex(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "Output written on gotex.pdf (1 page, 9 bytes)." >gotex.log
+`)
+	var dir = t.TempDir()
+	var log, err = RunLatex(context.Background(), strings.NewReader(""),
+		Options{Command: command}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(log, []byte("Output written")) {
+		t.Errorf("Should return the log, got %q", log)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gotex.pdf")); err != nil {
+		t.Errorf("Should leave the output in dir: %v", err)
+	}
+
+	command = fakeLatex(t, `cat >/dev/null
+echo "! Undefined control sequence." >gotex.log
+exit 1
+`)
+	log, err = RunLatex(context.Background(), strings.NewReader(""),
+		Options{Command: command}, dir)
+	var latexErr *LatexError
+	if !errors.As(err, &latexErr) {
+		t.Fatalf("Should return a LatexError, got %v", err)
+	}
+	if !bytes.Contains(log, []byte("Undefined control sequence")) {
+		t.Errorf("Should return the log on failure, got %q", log)
+	}
+
+	// Options that need files in dir don't apply, but Metadata does.
+	command = fakeLatex(t, `echo "$@" >args
+cat >gotex.tex
+`)
+	_, err = RunLatex(context.Background(), strings.NewReader("doc\n"),
+		Options{Command: command, Format: []byte("fmt"),
+			Metadata: Metadata{Title: "T"}}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var args, _ = ioutil.ReadFile(filepath.Join(dir, "args"))
+	if bytes.Contains(args, []byte("-fmt")) {
+		t.Errorf("Should ignore Format, got %q", args)
+	}
+	var tex, _ = ioutil.ReadFile(filepath.Join(dir, "gotex.tex"))
+	if !bytes.Contains(tex, []byte("pdftitle={T}")) {
+		t.Errorf("Should set the metadata, got %q", tex)
+	}
+
+	// latexmk gets the document as a file.
+	var latexmk = fakeLatex(t, `for arg; do echo "$arg"; done >args
+`)
+	_, err = RunLatex(context.Background(), strings.NewReader("doc\n"),
+		Options{Latexmk: true, LatexmkCommand: latexmk}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, _ = ioutil.ReadFile(filepath.Join(dir, "args"))
+	if !bytes.HasSuffix(args, []byte("\ngotex.tex\n")) {
+		t.Errorf("Should pass latexmk the document file, got %q", args)
+	}
+	if tex, _ = ioutil.ReadFile(filepath.Join(dir, "gotex.tex")); string(tex) != "doc\n" {
+		t.Errorf("Should write the document to dir, got %q", tex)
+	}
+}
+
+func TestRenderLogger(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "Rerun to get cross-references right." >gotex.log
+`)
+	var buf bytes.Buffer
+	var _, err = RenderFull("", Options{Command: command, Runs: 2,
+		Logger: log.New(&buf, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"starting run 2", "running " + command,
+		"log asks for another run", "removing "} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Log should mention %q, got:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRenderFile(t *testing.T) {
+	var command = fakeLatex(t, `for arg; do
+	case $arg in -output-directory=*) out=${arg#-output-directory=};; esac
+	file=$arg
+done
+cat "$file" sibling.tex >"$out/gotex.pdf"
+echo "$BIBINPUTS" >>"$out/gotex.pdf"
+`)
+	var dir = t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "main.tex"), []byte("main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sibling.tex"), []byte("sibling\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var pdf, err = RenderFile(filepath.Join(dir, "main.tex"), Options{Command: command,
+		Env: map[string]string{"BIBINPUTS": "/bibs"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = "main\nsibling\n" + dir + string(os.PathListSeparator) + "/bibs\n"
+	if string(pdf) != want {
+		t.Errorf("Should compile the file from its directory, got %q, want %q", pdf, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gotex.pdf")); err == nil {
+		t.Error("Should not write output next to the file")
+	}
+}
+
+func TestRenderProject(t *testing.T) {
+	// Build the "PDF" from the main file and whatever it includes.
+	var command = fakeLatex(t, `for file; do :; done
+cat "$file" $(cat "$file") >gotex.pdf
+`)
+	var pdf, err = RenderProject(Project{
+		Main: "book.tex",
+		Files: map[string][]byte{
+			"book.tex":          []byte("chapters/one.tex\n"),
+			"chapters/one.tex":  []byte("one\n"),
+			"chapters/two.tex":  []byte("two\n"),
+			"images/figure.png": []byte("png"),
+		},
+	}, Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "chapters/one.tex\none\n" {
+		t.Errorf("Should compile the main file, got %q", pdf)
+	}
+
+	_, err = RenderProject(Project{Main: "missing.tex"}, Options{Command: command})
+	if err == nil {
+		t.Error("Should reject a Main that isn't in Files")
+	}
+}
+
+func TestRenderOnLogLine(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+echo "This is pdfTeX"
+echo "LaTeX Warning: oops" >&2
+printf "(./gotex.aux)"
+`)
+	var lines []string
+	var _, err = Render("", Options{Command: command, OnLogLine: func(line string) {
+		lines = append(lines, line)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got = strings.Join(lines, "|")
+	for _, want := range []string{"This is pdfTeX", "LaTeX Warning: oops", "(./gotex.aux)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("OnLogLine should see %q, got %q", want, lines)
+		}
+	}
+	if len(lines) != 3 {
+		t.Errorf("Should split the output into lines, got %q", lines)
+	}
+}
+
+func TestRenderCommandError(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "kpathsea: Running mktexfmt pdflatex.fmt" >&2
+exit 3
+`)
+	var _, err = Render("", Options{Command: command, TempDir: t.TempDir()})
+	var latexErr *LatexError
+	if !errors.As(err, &latexErr) || latexErr.ExitCode != 3 {
+		t.Fatalf("Should return a LatexError with the exit code, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "mktexfmt") {
+		t.Errorf("Should include stderr in the error, got %v", err)
+	}
+
+	// The end of the log goes in the message, within reason.
+	command = fakeLatex(t, `cat >/dev/null
+seq 1 100 >gotex.log
+echo "! Undefined control sequence." >>gotex.log
+exit 1
+`)
+	_, err = Render("", Options{Command: command, TempDir: t.TempDir()})
+	if !errors.As(err, &latexErr) || !bytes.HasPrefix(latexErr.Log, []byte("1\n2\n")) {
+		t.Fatalf("Should include the whole log, got %v", err)
+	}
+	var msg = err.Error()
+	if !strings.HasSuffix(msg, "\n82\n83\n84\n85\n86\n87\n88\n89\n90\n91\n92\n93\n94\n95\n96\n97\n98\n99\n100\n! Undefined control sequence.") ||
+		strings.Contains(msg, "\n81\n") {
+		t.Errorf("Should end with 20 lines of the log, got %q", msg)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Error("Should wrap the exec error")
+	}
+
+	var tempDir = t.TempDir()
+	_, err = Render("", Options{Command: "gotex-no-such-latex", TempDir: tempDir})
+	if !errors.Is(err, ErrCommandNotFound) || !errors.Is(err, exec.ErrNotFound) ||
+		errors.As(err, &latexErr) {
+		t.Errorf("Should say the command wasn't found, got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Should remove the temporary directory, left %d", len(entries))
+	}
+	_, err = Render("", Options{Command: filepath.Join(t.TempDir(), "pdflatex")})
+	if !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Should say a missing path wasn't found, got %v", err)
+	}
+
+	// The same goes for the other tools.
+	command = fakeLatex(t, `cat >/dev/null
+printf '%s\n' '\citation{knuth}' '\bibdata{refs}' >gotex.aux
+echo "%PDF-1.5" >gotex.pdf
+`)
+	_, err = Render("", Options{Command: command, BibEngine: "bibtex",
+		BibCommand: "gotex-no-such-bibtex", TempDir: t.TempDir()})
+	var toolErr *ToolError
+	if !errors.Is(err, ErrCommandNotFound) || !errors.As(err, &toolErr) {
+		t.Errorf("Should say a missing tool wasn't found, got %v", err)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	var command = fakeLatex(t, `echo "pdfTeX 3.141592653-2.6-1.40.25 (TeX Live 2023)"
+echo "kpathsea version 6.3.5"
+`)
+	var version, err = Version(Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "pdfTeX 3.141592653-2.6-1.40.25 (TeX Live 2023)" {
+		t.Errorf("Should return the first line, got %q", version)
+	}
+	_, err = Version(Options{Command: "gotex-no-such-latex"})
+	if !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Should say the command wasn't found, got %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var command = fakeLatex(t, "")
+	if err := Check(Options{Command: command}); err != nil {
+		t.Errorf("Should find the command: %v", err)
+	}
+	var err = Check(Options{Command: "gotex-no-such-latex"})
+	if !errors.Is(err, ErrCommandNotFound) || !strings.Contains(err.Error(), "gotex-no-such-latex") {
+		t.Errorf("Should say the command wasn't found, got %v", err)
+	}
+	err = Check(Options{Command: command, MakeIndex: true,
+		MakeIndexCommand: "gotex-no-such-makeindex"})
+	if !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Should check the other tools too, got %v", err)
+	}
+}
+
+func TestRenderFailOnWarnings(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "%PDF-1.5" >gotex.pdf
+cat >gotex.log <<'LOG'
+LaTeX Warning: Reference `+"`fig:1'"+` on page 1 undefined on input line 12.
+Overfull \hbox (12.3pt too wide) in paragraph at lines 30--32
+LOG
+`)
+	var result, err = RenderFull("", Options{Command: command,
+		FailOnWarnings: []WarningKind{UndefinedReference}})
+	var warningErr *WarningError
+	if !errors.As(err, &warningErr) {
+		t.Fatalf("Should fail on an undefined reference, got %v", err)
+	}
+	if len(warningErr.Warnings) != 1 || warningErr.Warnings[0].Line != 12 {
+		t.Errorf("Should only include the fatal warnings, got %v", warningErr.Warnings)
+	}
+	if !bytes.HasPrefix(result.Pdf, []byte("%PDF")) {
+		t.Error("Should still return the PDF")
+	}
+
+	_, err = RenderFull("", Options{Command: command,
+		FailOnWarnings: []WarningKind{UndefinedCitation}})
+	if err != nil {
+		t.Errorf("Should ignore other kinds of warnings, got %v", err)
+	}
+}
+
+func TestRenderWriteSource(t *testing.T) {
+	// Compile whatever file is named last, ignoring stdin.
+	var command = fakeLatex(t, `for file; do :; done
+cat "$file" >doc.pdf
+echo "$file" >>doc.pdf
+`)
+	var pdf, err = Render("%PDF-1.5\n", Options{Command: command, Jobname: "doc",
+		WriteSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "%PDF-1.5\ndoc.tex\n" {
+		t.Errorf("Should compile the document from a file, got %q", pdf)
+	}
+}
+
+func TestRenderMany(t *testing.T) {
+	// Echo the document back, failing on "bad".
+	var command = fakeLatex(t, `cat >gotex.pdf
+if grep -q bad gotex.pdf; then exit 1; fi
+`)
+	var docs = []string{"%PDF-0", "%PDF-1", "bad", "%PDF-3", "%PDF-4"}
+	var pdfs, errs = RenderMany(docs, Options{Command: command, TempDir: t.TempDir()}, 2)
+	if len(pdfs) != len(docs) || len(errs) != len(docs) {
+		t.Fatalf("Should return a result for each document, got %d and %d", len(pdfs), len(errs))
+	}
+	for i, doc := range docs {
+		if doc == "bad" {
+			if errs[i] == nil || pdfs[i] != nil {
+				t.Errorf("Document %d should fail without a PDF", i)
+			}
+			continue
+		}
+		if errs[i] != nil || string(pdfs[i]) != doc {
+			t.Errorf("Document %d should render to %q, got %q, %v", i, doc, pdfs[i], errs[i])
+		}
+	}
+}
+
+func TestRenderConcurrent(t *testing.T) {
+	// Echo the document back after a little work, with Env and Files in play
+	// to check that shared Options are only read.
+	var command = fakeLatex(t, `cat >gotex.pdf
+cat shared.tex >>gotex.pdf
+echo "$GOTEX_TEST" >>gotex.pdf
+`)
+	var options = Options{
+		Command: command,
+		Env:     map[string]string{"GOTEX_TEST": "env"},
+		Files:   map[string][]byte{"shared.tex": []byte("shared\n")},
+	}
+	const n = 50
+	var errs = make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			var doc = "%PDF-" + strconv.Itoa(i) + "\n"
+			var pdf, err = Render(doc, options)
+			if err == nil && string(pdf) != doc+"shared\nenv\n" {
+				err = errors.New("wrong PDF for " + strconv.Itoa(i) + ": " + string(pdf))
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCompileFormat(t *testing.T) {
+	// Dump the preamble as the "format", and put the format in the "PDF".
+	var command = fakeLatex(t, `for arg; do
+	case $arg in -ini) ini=1;; -fmt=*) fmt=${arg#-fmt=};; esac
+done
+if [ -n "$ini" ]; then
+	echo "$@" >gotex-format.fmt
+	cat preamble.tex >>gotex-format.fmt
+	exit
+fi
+cat >/dev/null
+cat "$fmt.fmt" >gotex.pdf
+`)
+	var format, err = CompileFormat("\\documentclass{article}\n", Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(format, []byte("&pdflatex mylatexformat.ltx preamble.tex\n\\documentclass{article}")) {
+		t.Errorf("Should dump the preamble with mylatexformat, got %q", format)
+	}
+	pdf, err := Render("", Options{Command: command, Format: format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pdf, format) {
+		t.Errorf("Should render with the format, got %q", pdf)
+	}
+	pdf, err = RenderWith("", WithCommand(command), WithFormat(format))
+	if err != nil || !bytes.Equal(pdf, format) {
+		t.Errorf("Should render with WithFormat, got %q, %v", pdf, err)
+	}
+
+	// Failures follow the same rules for the temporary directory as renders.
+	var base = t.TempDir()
+	_, err = CompileFormat("", Options{Command: fakeLatex(t, "exit 1\n"), TempDir: base,
+		CleanOnError: true})
+	var latexErr *LatexError
+	if !errors.As(err, &latexErr) {
+		t.Error("Should return a LatexError, got", err)
+	}
+	_, err = CompileFormat("", Options{Command: fakeLatex(t, "exit 0\n"), TempDir: base})
+	if err == nil {
+		t.Error("Should fail without a format file")
+	}
+	_, err = CompileFormat("", Options{Command: fakeLatex(t, "exec sleep 10\n"), TempDir: base,
+		CleanOnError: true, Timeout: 100 * time.Millisecond})
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("Should return ErrTimeout, got", err)
+	}
+	if entries, _ := ioutil.ReadDir(base); len(entries) != 0 {
+		t.Errorf("Should remove the temporary directory, left %d", len(entries))
+	}
+}
+
+// mapCache is a Cache for tests.
+type mapCache map[string][]byte
+
+func (c mapCache) Get(key string) ([]byte, bool) {
+	var output, ok = c[key]
+	return output, ok
+}
+
+func (c mapCache) Put(key string, output []byte) {
+	c[key] = output
+}
+
+func TestRenderCache(t *testing.T) {
+	var command = fakeLatex(t, `cat >gotex.pdf
+`)
+	var cache = mapCache{}
+	var options = Options{Command: command, Cache: cache,
+		Files: map[string][]byte{"a.tex": []byte("a")}}
+	var result, err = RenderFull("%PDF-1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cached || len(cache) != 1 {
+		t.Fatalf("Should render and store the output, got %d entries", len(cache))
+	}
+	result, err = RenderFull("%PDF-1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Cached || string(result.Pdf) != "%PDF-1" {
+		t.Errorf("Should use the cached output, got %q", result.Pdf)
+	}
+
+	// Anything that could change the output is a different render.
+	var path = filepath.Join(t.TempDir(), "out.pdf")
+	if err := RenderToFile(path, "%PDF-2", options); err != nil {
+		t.Fatal(err)
+	}
+	options.Files = map[string][]byte{"a.tex": []byte("b")}
+	if _, err := Render("%PDF-1", options); err != nil {
+		t.Fatal(err)
+	}
+	options.ExtraArgs = []string{"-synctex=1"}
+	if _, err := Render("%PDF-1", options); err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 4 {
+		t.Errorf("Should store each distinct render, got %d entries", len(cache))
+	}
+	if pdf, err := ioutil.ReadFile(path); err != nil || string(pdf) != "%PDF-2" {
+		t.Errorf("Should still deliver the output, got %q, %v", pdf, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	// Each render leaves a marker while it runs and checks how many others
+	// are running.
+	var running = t.TempDir()
+	var command = fakeLatex(t, `cat >gotex.pdf
+touch "`+running+`/$$"
+sleep 0.1
+ls "`+running+`" | wc -l >>gotex.pdf
+rm "`+running+`/$$"
+`)
+	var pool = NewPool(2)
+	var errs = make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		go func() {
+			var pdf, err = pool.Render("", Options{Command: command})
+			if err == nil {
+				var n, _ = strconv.Atoi(strings.TrimSpace(string(pdf)))
+				if n < 1 || n > 2 {
+					err = errors.New("ran " + strconv.Itoa(n) + " renders at once")
+				}
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Waiting for a slot respects the context.
+	var full = NewPool(1)
+	full.slots <- struct{}{}
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := full.RenderContext(ctx, "", Options{Command: command}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Should give up waiting when the context is done, got %v", err)
+	}
+}
+
+func TestRenderCleanOnError(t *testing.T) {
+	var command = fakeLatex(t, `cat >/dev/null
+echo "! Undefined control sequence." >gotex.log
+exit 1
+`)
+	var base = t.TempDir()
+	var result, err = RenderFull("", Options{Command: command, TempDir: base, CleanOnError: true})
+	var latexErr *LatexError
+	if !errors.As(err, &latexErr) || !bytes.Contains(latexErr.Log, []byte("Undefined")) {
+		t.Fatalf("Should still return the log, got %v", err)
+	}
+	if entries, _ := ioutil.ReadDir(base); len(entries) != 0 || result.Dir != "" {
+		t.Error("Should remove the temporary directory")
+	}
+
+	result, err = RenderFull("", Options{Command: command, TempDir: base})
+	if err == nil || result.Dir == "" {
+		t.Fatalf("Should keep the temporary directory by default, got %v", err)
+	}
+}
+
+func TestRenderReproducible(t *testing.T) {
+	// Stamp the "PDF" with the current time, unless told otherwise.
+	var command = fakeLatex(t, `cat >/dev/null
+echo "${SOURCE_DATE_EPOCH:-$(date +%s%N)} $FORCE_SOURCE_DATE" >gotex.pdf
+`)
+	var first, err = Render("", Options{Command: command, Reproducible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second, err := Render("", Options{Command: command, Reproducible: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) || string(first) != "0 1\n" {
+		t.Errorf("Should render the same bytes twice, got %q and %q", first, second)
+	}
+
+	pdf, err := Render("", Options{Command: command, Reproducible: true,
+		Env: map[string]string{"SOURCE_DATE_EPOCH": "1500000000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != "1500000000 1\n" {
+		t.Errorf("Should use the date from Env, got %q", pdf)
+	}
+}
+
+func TestRenderMetadata(t *testing.T) {
+	var command = fakeLatex(t, "cat >gotex.pdf\n")
+	var pdf, err = Render("doc\n", Options{Command: command,
+		Metadata: Metadata{Title: "Q&A", Author: "Me"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = `\AddToHook{begindocument/before}{\RequirePackage{hyperref}` +
+		`\hypersetup{pdftitle={Q\&A},pdfauthor={Me}}}` + "doc\n"
+	if string(pdf) != want {
+		t.Errorf("Should set the metadata before the document, got %q", pdf)
+	}
+
+	pdf, err = Render("doc\n", Options{Command: command})
+	if err != nil || string(pdf) != "doc\n" {
+		t.Errorf("Should leave the document alone without metadata, got %q, %v", pdf, err)
+	}
+
+	// A format would skip the metadata along with the preamble, so LaTeX
+	// shouldn't get to see the document at all.
+	var input = filepath.Join(t.TempDir(), "input")
+	command = fakeLatex(t, "cat >"+input+"\n")
+	_, err = Render("doc\n", Options{Command: command, Format: []byte("fmt"),
+		Metadata: Metadata{Title: "T"}})
+	if err == nil {
+		t.Error("Should reject Metadata with Format")
+	}
+	if _, statErr := os.Stat(input); !os.IsNotExist(statErr) {
+		t.Error("Should not run LaTeX with Metadata and Format")
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	var command = fakeLatex(t, "cat >gotex.pdf\n")
+	var data = struct{ Name, Body string }{"R&D", `\emph{hi}`}
+	var pdf, err = RenderTemplate(`\section{<< .Name | escape >>} << .Body >>`,
+		data, Options{Command: command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pdf) != `\section{R\&D} \emph{hi}` {
+		t.Errorf("Should fill in the template, got %q", pdf)
+	}
+
+	_, err = RenderTemplate("<< .Missing", nil, Options{Command: command})
+	if err == nil {
+		t.Error("Should return template errors")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var command = fakeLatex(t, `cat >gotex.pdf
+if grep -q bad gotex.pdf; then echo "! Undefined control sequence." >gotex.log; exit 1; fi
+if grep -q warn gotex.pdf; then echo 'Overfull \hbox (1.0pt too wide) in paragraph at lines 1--2' >gotex.log; fi
+`)
+	var tempDir = t.TempDir()
+	var server = httptest.NewServer(Handler(Options{Command: command, TempDir: tempDir,
+		FailOnWarnings: []WarningKind{OverfullBox}}))
+	defer server.Close()
+
+	var resp, err = http.Post(server.URL, "text/x-tex", strings.NewReader("%PDF-1.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "%PDF-1.5" ||
+		resp.Header.Get("Content-Type") != "application/pdf" {
+		t.Errorf("Should respond with the PDF, got %d %q %q", resp.StatusCode,
+			resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, err = http.Post(server.URL, "text/x-tex", strings.NewReader("bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity ||
+		!strings.Contains(string(body), "Undefined control sequence") {
+		t.Errorf("Should respond with the log, got %d %q", resp.StatusCode, body)
+	}
+	if entries, _ := ioutil.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Should remove the temporary directory, left %d", len(entries))
+	}
+
+	resp, err = http.Post(server.URL, "text/x-tex", strings.NewReader("warn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity ||
+		!strings.Contains(string(body), "Overfull") {
+		t.Errorf("Should respond with the warnings, got %d %q", resp.StatusCode, body)
+	}
+
+	var slow = httptest.NewServer(Handler(Options{Command: fakeLatex(t, "exec sleep 10\n"),
+		TempDir: tempDir, Timeout: 100 * time.Millisecond}))
+	defer slow.Close()
+	resp, err = http.Post(slow.URL, "text/x-tex", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Error("Should time out with a 504, got", resp.StatusCode)
+	}
+
+	// A missing tool is the server's fault, not the document's.
+	var cite = fakeLatex(t, `cat >/dev/null
+printf '%s\n' '\citation{knuth}' '\bibdata{refs}' >gotex.aux
+echo "%PDF-1.5" >gotex.pdf
+`)
+	var broken = httptest.NewServer(Handler(Options{Command: cite, TempDir: tempDir,
+		BibEngine: "bibtex", BibCommand: "gotex-no-such-bibtex"}))
+	defer broken.Close()
+	resp, err = http.Post(broken.URL, "text/x-tex", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Error("Should respond with a 500 for a missing tool, got", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Should only accept POST, got", resp.StatusCode)
+	}
+}
+
+func TestRenderDryRun(t *testing.T) {
+	var command = fakeLatex(t, "echo ran >ran\n")
+	var runs int
+	var _, err = Render("doc", Options{Command: command, DryRun: true,
+		Env: map[string]string{"FOO": "bar"}, ExtraArgs: []string{"-8bit", "a b"},
+		CleanOnError: true, TempDir: t.TempDir(),
+		OnRun: func(run, total int) { runs++ }})
+	var dryRun *DryRunError
+	if !errors.As(err, &dryRun) {
+		t.Fatalf("Should return a DryRunError, got %v", err)
+	}
+	defer os.RemoveAll(dryRun.Dir)
+	var want = []string{command, "-jobname=gotex", "-interaction=nonstopmode",
+		"-halt-on-error", "-no-shell-escape", "-8bit", "a b", "gotex.tex"}
+	if !reflect.DeepEqual(dryRun.Args, want) {
+		t.Errorf("Wrong arguments %q", dryRun.Args)
+	}
+	if len(dryRun.Env) == 0 || dryRun.Env[len(dryRun.Env)-1] != "FOO=bar" {
+		t.Errorf("Should include the environment, got %q", dryRun.Env)
+	}
+	if tex, _ := ioutil.ReadFile(filepath.Join(dryRun.Dir, "gotex.tex")); string(tex) != "doc" {
+		t.Errorf("Should leave the document in the directory, got %q", tex)
+	}
+	if _, err := os.Stat(filepath.Join(dryRun.Dir, "ran")); err == nil || runs != 0 {
+		t.Error("Shouldn't run LaTeX")
+	}
+	if !strings.HasSuffix(err.Error(), "-8bit 'a b' gotex.tex") {
+		t.Errorf("Should quote the command line, got %q", err)
+	}
+}
+
+func TestRenderPDFA(t *testing.T) {
+	var command = fakeLatex(t, "cat >gotex.pdf\n")
+	// Mark the PDF and keep the arguments and the definitions file.
+	var gs = fakeLatex(t, `for arg; do
+	case $arg in -sOutputFile=*) out=${arg#-sOutputFile=};; esac
+	echo "$arg" >>gs-args
+done
+for input; do :; done
+cat gotex-pdfa.ps >gs-def
+{ echo "PDF/A"; cat "$input"; } >"$out"
+`)
+	var options = Options{Command: command, GhostscriptCommand: gs, PDFA: 2,
+		PDFAProfile: "/icc/s(RGB).icc", KeepTemp: true}
+	var result, err = RenderFull("%PDF-1.5\n", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(result.Dir)
+	if string(result.Pdf) != "PDF/A\n%PDF-1.5\n" {
+		t.Errorf("Should return the converted PDF, got %q", result.Pdf)
+	}
+	var args, _ = ioutil.ReadFile(filepath.Join(result.Dir, "gs-args"))
+	for _, arg := range []string{"-dPDFA=2\n", "-sDEVICE=pdfwrite\n",
+		"--permit-file-read=/icc/s(RGB).icc\n", "gotex-pdfa.ps\ngotex.pdf\n"} {
+		if !bytes.Contains(args, []byte(arg)) {
+			t.Errorf("Should pass %q to Ghostscript, got %q", arg, args)
+		}
+	}
+	var def, _ = ioutil.ReadFile(filepath.Join(result.Dir, "gs-def"))
+	if !bytes.Contains(def, []byte(`/ICCProfile (/icc/s\(RGB\).icc) def`)) {
+		t.Errorf("Should point the output intent at the profile, got %q", def)
+	}
+
+	options.GhostscriptCommand = "gotex-no-such-gs"
+	options.TempDir = t.TempDir()
+	_, err = Render("", options)
+	if !errors.Is(err, ErrCommandNotFound) {
+		t.Error("Should fail without Ghostscript, got", err)
+	}
+	for _, bad := range []Options{
+		{Command: command, PDFA: 4, PDFAProfile: "x"},
+		{Command: command, PDFA: 1},
+		{Command: command, PDFA: 1, PDFAProfile: "x", OutputFormat: DVI},
+	} {
+		if _, err = Render("", bad); err == nil {
+			t.Errorf("Should reject PDFA %d with %q and %v", bad.PDFA, bad.PDFAProfile, bad.OutputFormat)
+		}
+	}
+}
+
+func TestRenderInfo(t *testing.T) {
+	var command = fakeLatex(t, "cat >/dev/null\ncp in.pdf gotex.pdf\n")
+	var options = Options{Command: command, Files: map[string][]byte{"in.pdf": testPDF()},
+		InfoDate: time.Unix(0, 0)}
+	var pdf, err = Render("", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(pdf, []byte("/CreationDate (D:19700101000000Z)")) {
+		t.Errorf("Should set the date, got %q", pdf)
+	}
+
+	options.PDFA, options.PDFAProfile = 1, "srgb.icc"
+	if _, err = Render("", options); err == nil {
+		t.Error("Should refuse to rewrite a PDF/A")
+	}
+}
+
+func TestRenderOptimize(t *testing.T) {
+	var command = fakeLatex(t, "cat >gotex.pdf\n")
+	var gs = fakeLatex(t, `for arg; do
+	case $arg in -sOutputFile=*) out=${arg#-sOutputFile=};; esac
+done
+for input; do :; done
+{ echo "$@"; cat "$input"; } >"$out"
+`)
+	var pdf, err = Render("%PDF-1.5\n", Options{Command: command,
+		GhostscriptCommand: gs, Optimize: true, OptimizeDPI: 96})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"-sDEVICE=pdfwrite", "-dCompatibilityLevel=1.5",
+		"-dColorImageResolution=96", "-dGrayImageResolution=96", "gotex.pdf\n%PDF-1.5\n"} {
+		if !bytes.Contains(pdf, []byte(arg)) {
+			t.Errorf("Should pass %q to Ghostscript, got %q", arg, pdf)
+		}
+	}
+
+	pdf, err = Render("%PDF-1.5\n", Options{Command: command,
+		GhostscriptCommand: gs, Optimize: true})
+	if err != nil || !bytes.Contains(pdf, []byte("-dColorImageResolution=150")) {
+		t.Errorf("Should default to 150 DPI, got %q, %v", pdf, err)
+	}
+
+	_, err = Render("", Options{Command: command, Optimize: true, OutputFormat: DVI})
+	if err == nil {
+		t.Error("Should only optimize PDF output")
+	}
+}
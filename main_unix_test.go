@@ -0,0 +1,48 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+//go:build unix
+
+package gotex
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRenderContextCancelGroup(t *testing.T) {
+	// Start a helper that ignores SIGTERM, like a stubborn shell escape
+	// program, and record its PID.
+	var pidFile = filepath.Join(t.TempDir(), "helper.pid")
+	var command = fakeLatex(t, `cat >/dev/null
+sh -c 'trap "" TERM; while :; do sleep 0.1; done' &
+echo $! >`+pidFile+`
+wait
+`)
+	var ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := RenderContext(ctx, "", Options{Command: command}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Should be cancelled, got %v", err)
+	}
+	var pid, err = ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var helper, _ = strconv.Atoi(strings.TrimSpace(string(pid)))
+	// The helper gets SIGKILL once the grace period is up.
+	var deadline = time.Now().Add(killGracePeriod + 2*time.Second)
+	for syscall.Kill(helper, 0) == nil {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(helper, syscall.SIGKILL)
+			t.Fatal("Should kill the whole process group")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"time"
+)
+
+// Option sets one of the fields of Options, for use with RenderWith.
+type Option func(*Options)
+
+// RenderWith is like Render, but takes its options as a list of Option
+// functions, which reads better when only a few need to be set:
+//
+//	var pdf, err = gotex.RenderWith(document,
+//		gotex.WithCommand("/usr/bin/pdflatex"),
+//		gotex.WithTimeout(time.Minute))
+func RenderWith(document string, opts ...Option) ([]byte, error) {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return Render(document, options)
+}
+
+// WithEngine sets Options.Engine.
+func WithEngine(engine Engine) Option {
+	return func(o *Options) { o.Engine = engine }
+}
+
+// WithCommand sets Options.Command.
+func WithCommand(command string) Option {
+	return func(o *Options) { o.Command = command }
+}
+
+// WithRuns sets Options.Runs.
+func WithRuns(runs int) Option {
+	return func(o *Options) { o.Runs = runs }
+}
+
+// WithTimeout sets Options.Timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) { o.Timeout = timeout }
+}
+
+// WithTexinputs adds directories to Options.TexinputsDirs.
+func WithTexinputs(dirs ...string) Option {
+	return func(o *Options) { o.TexinputsDirs = append(o.TexinputsDirs, dirs...) }
+}
+
+// WithFile adds a file to Options.Files.
+func WithFile(name string, contents []byte) Option {
+	return func(o *Options) {
+		if o.Files == nil {
+			o.Files = make(map[string][]byte)
+		}
+		o.Files[name] = contents
+	}
+}
+
+// WithFormat sets Options.Format to a format file from CompileFormat.
+func WithFormat(format []byte) Option {
+	return func(o *Options) { o.Format = format }
+}
+
+// WithEnv sets an environment variable in Options.Env.
+func WithEnv(key, value string) Option {
+	return func(o *Options) {
+		if o.Env == nil {
+			o.Env = make(map[string]string)
+		}
+		o.Env[key] = value
+	}
+}
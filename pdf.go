@@ -0,0 +1,234 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// escapeString escapes the inside of a literal string, which is written the
+// same way in PDF and PostScript.
+var escapeString = strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+
+// ghostscript runs the PDF for the jobname in dir through Ghostscript's
+// pdfwrite device with the given arguments, and replaces it with the result.
+func ghostscript(ctx context.Context, options Options, dir string, args ...string) error {
+	var name = options.Jobname + ".pdf"
+	var out = options.Jobname + "-gs.pdf"
+	args = append([]string{"-dSAFER", "-dBATCH", "-dNOPAUSE", "-q",
+		"-sDEVICE=pdfwrite", "-sOutputFile=" + out}, args...)
+	var err = runTool(ctx, options, dir, "", options.GhostscriptCommand,
+		append(args, name)...)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path.Join(dir, out), path.Join(dir, name))
+}
+
+// optimize shrinks the PDF for the jobname in dir by having Ghostscript
+// rewrite it with its images downsampled to options.OptimizeDPI.
+func optimize(ctx context.Context, options Options, dir string) error {
+	var dpi = strconv.Itoa(options.OptimizeDPI)
+	return ghostscript(ctx, options, dir, "-dCompatibilityLevel=1.5",
+		"-dDownsampleColorImages=true", "-dColorImageResolution="+dpi,
+		"-dDownsampleGrayImages=true", "-dGrayImageResolution="+dpi)
+}
+
+// pdfaDef is the PostScript Ghostscript needs to add the output intent that
+// PDF/A requires. It is adapted from the PDFA_def.ps that comes with it, and
+// %s is the path to the ICC profile, as a PostScript string.
+const pdfaDef = `%!
+/ICCProfile %s def
+[/_objdef {icc_PDFA} /type /stream /OBJ pdfmark
+[{icc_PDFA} <</N 3>> /PUT pdfmark
+[{icc_PDFA} ICCProfile (r) file /PUT pdfmark
+[/_objdef {OutputIntent_PDFA} /type /dict /OBJ pdfmark
+[{OutputIntent_PDFA} <<
+  /Type /OutputIntent
+  /S /GTS_PDFA1
+  /DestOutputProfile {icc_PDFA}
+  /OutputConditionIdentifier (sRGB)
+>> /PUT pdfmark
+[{Catalog} <</OutputIntents [ {OutputIntent_PDFA} ]>> /PUT pdfmark
+`
+
+// convertPDFA turns the PDF for the jobname in dir into PDF/A, as options ask.
+func convertPDFA(ctx context.Context, options Options, dir string) error {
+	// Ghostscript's -dSAFER only lets it read files it's told about.
+	var profile, err = filepath.Abs(options.PDFAProfile)
+	if err != nil {
+		return err
+	}
+	var def = options.Jobname + "-pdfa.ps"
+	err = ioutil.WriteFile(path.Join(dir, def),
+		[]byte(strings.Replace(pdfaDef, "%s", "("+escapeString.Replace(profile)+")", 1)), 0644)
+	if err != nil {
+		return err
+	}
+	// Policy 2 makes Ghostscript give up on anything it can't make
+	// compliant, rather than write a PDF that isn't.
+	return ghostscript(ctx, options, dir, "-dPDFA="+strconv.Itoa(options.PDFA),
+		"-dPDFACompatibilityPolicy=2", "-sColorConversionStrategy=RGB",
+		"--permit-file-read="+profile, def)
+}
+
+// The parts of a PDF's trailer that setInfo needs.
+var (
+	startXref = regexp.MustCompile(`startxref\s+(\d+)`)
+	infoRef   = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	rootRef   = regexp.MustCompile(`/Root\s+\d+\s+\d+\s+R`)
+	sizeEntry = regexp.MustCompile(`/Size\s+(\d+)`)
+	idEntry   = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+)
+
+// The Info entries setInfo replaces. The values are strings, either literal
+// or hex.
+var (
+	dateEntries   = regexp.MustCompile(`\s*/(CreationDate|ModDate)\s*(\((\\.|[^\\)])*\)|<[^>]*>)`)
+	producerEntry = regexp.MustCompile(`\s*/Producer\s*(\((\\.|[^\\)])*\)|<[^>]*>)`)
+)
+
+// setInfo returns pdf with an incremental update that sets the creation and
+// modification dates in its Info dictionary to date, unless it's zero, and
+// the producer to producer, unless it's empty. The other entries are kept.
+// It only understands an Info dictionary that isn't in an object stream,
+// which is how pdfTeX and friends write it.
+func setInfo(pdf []byte, date time.Time, producer string) ([]byte, error) {
+	var matches = startXref.FindAllSubmatch(pdf, -1)
+	if len(matches) == 0 {
+		return nil, errors.New("gotex: can't find the PDF's startxref")
+	}
+	var prev, err = strconv.Atoi(string(matches[len(matches)-1][1]))
+	if err != nil || prev >= len(pdf) {
+		return nil, errors.New("gotex: bad startxref in the PDF")
+	}
+	// The trailer follows an xref table, or is the dictionary of an xref
+	// stream. Either way, it's the next dictionary.
+	var trailer = pdfDict(pdf, prev)
+	var info = infoRef.FindSubmatch(trailer)
+	var root = rootRef.Find(trailer)
+	var size = sizeEntry.FindSubmatch(trailer)
+	if info == nil || root == nil || size == nil {
+		return nil, errors.New("gotex: can't find the PDF's Info dictionary")
+	}
+	var num, gen = string(info[1]), string(info[2])
+	var obj = regexp.MustCompile(`(^|[^0-9])` + num + `\s+` + gen + `\s+obj\b`)
+	var locs = obj.FindAllIndex(pdf, -1)
+	if len(locs) == 0 {
+		return nil, errors.New("gotex: can't find the PDF's Info dictionary")
+	}
+	var dict = pdfDict(pdf, locs[len(locs)-1][1])
+	if dict == nil {
+		return nil, errors.New("gotex: can't find the PDF's Info dictionary")
+	}
+
+	var body = dict[2 : len(dict)-2]
+	var entries string
+	if !date.IsZero() {
+		body = dateEntries.ReplaceAll(body, nil)
+		var d = "(D:" + date.UTC().Format("20060102150405") + "Z)"
+		entries += " /CreationDate " + d + " /ModDate " + d
+	}
+	if producer != "" {
+		body = producerEntry.ReplaceAll(body, nil)
+		entries += " /Producer (" + escapeString.Replace(producer) + ")"
+	}
+
+	var buf bytes.Buffer
+	buf.Write(pdf)
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	var offset = buf.Len()
+	fmt.Fprintf(&buf, "%s %s obj\n<< %s%s >>\nendobj\n", num, gen, bytes.TrimSpace(body), entries)
+	var xref = buf.Len()
+	var g, _ = strconv.Atoi(gen)
+	fmt.Fprintf(&buf, "xref\n%s 1\n%010d %05d n \ntrailer\n<< /Size %s %s /Info %s %s R /Prev %d",
+		num, offset, g, size[1], root, num, gen, prev)
+	if id := idEntry.Find(trailer); id != nil {
+		fmt.Fprintf(&buf, " %s", id)
+	}
+	fmt.Fprintf(&buf, " >>\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes(), nil
+}
+
+// pdfDict returns the dictionary that starts at the first "<<" at or after
+// start in pdf, including its delimiters, or nil if there isn't a whole one.
+func pdfDict(pdf []byte, start int) []byte {
+	var i = bytes.Index(pdf[start:], []byte("<<"))
+	if i < 0 {
+		return nil
+	}
+	i += start
+	var depth int
+	for j := i; j < len(pdf); j++ {
+		switch {
+		case pdf[j] == '(':
+			j = skipString(pdf, j)
+		case bytes.HasPrefix(pdf[j:], []byte("<<")):
+			depth++
+			j++
+		case bytes.HasPrefix(pdf[j:], []byte(">>")):
+			depth--
+			j++
+			if depth == 0 {
+				return pdf[i : j+1]
+			}
+		case pdf[j] == '<':
+			// A hex string.
+			var end = bytes.IndexByte(pdf[j:], '>')
+			if end < 0 {
+				return nil
+			}
+			j += end
+		}
+	}
+	return nil
+}
+
+// skipString returns the index of the parenthesis that closes the literal
+// string starting at pdf[i]. Parentheses in it may be balanced or escaped.
+func skipString(pdf []byte, i int) int {
+	var depth int
+	for ; i < len(pdf); i++ {
+		switch pdf[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return i
+}
+
+// rewriteInfo applies Options.InfoDate and Options.InfoProducer to the PDF
+// for the jobname in dir.
+func rewriteInfo(options Options, dir string) error {
+	var name = path.Join(dir, options.Jobname+".pdf")
+	var pdf, err = ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	pdf, err = setInfo(pdf, options.InfoDate, options.InfoProducer)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, pdf, 0644)
+}
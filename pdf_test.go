@@ -0,0 +1,146 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPDF builds a small PDF with an xref table, so the offsets are right.
+func testPDF() []byte {
+	var objects = []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [] /Count 0 >>",
+		"<< /Title (A \\(tricky\\) >> title) /Producer (pdfTeX-1.40.25) " +
+			"/CreationDate (D:20240101120000+01'00') /ModDate <443A32303234> >>",
+	}
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	var offsets []int
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	var xref = buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R /ID [<01> <02>] >>\n"+
+		"startxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+// testXrefStreamPDF builds the same PDF with an xref stream instead, as
+// pdfTeX writes by default. The stream isn't compressed.
+func testXrefStreamPDF() []byte {
+	var pdf = testPDF()
+	var buf bytes.Buffer
+	buf.Write(pdf[:bytes.Index(pdf, []byte("xref\n"))])
+	var offsets = []int{0}
+	for i := 1; i <= 3; i++ {
+		offsets = append(offsets, bytes.Index(pdf, []byte(fmt.Sprintf("%d 0 obj", i))))
+	}
+	var xref = buf.Len()
+	offsets = append(offsets, xref)
+	var entries bytes.Buffer
+	entries.Write([]byte{0, 0, 0, 0xff})
+	for _, offset := range offsets[1:] {
+		entries.Write([]byte{1, byte(offset >> 8), byte(offset), 0})
+	}
+	fmt.Fprintf(&buf, "4 0 obj\n<< /Type /XRef /Size 5 /W [1 2 1] /Root 1 0 R /Info 3 0 R "+
+		"/ID [<01> <02>] /Length %d >>\nstream\n", entries.Len())
+	buf.Write(entries.Bytes())
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xref)
+	return buf.Bytes()
+}
+
+func TestSetInfo(t *testing.T) {
+	var pdf = testPDF()
+	var updated, err = setInfo(pdf, time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC), "gotex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(updated, pdf) {
+		t.Fatal("Should only append to the PDF")
+	}
+	var update = string(updated[len(pdf):])
+	var want = "3 0 obj\n<< /Title (A \\(tricky\\) >> title)" +
+		" /CreationDate (D:20170304050607Z) /ModDate (D:20170304050607Z) /Producer (gotex) >>\nendobj\n"
+	if update[:len(want)] != want {
+		t.Errorf("Wrong Info dictionary %q", update)
+	}
+
+	// The new xref entry and startxref have to point at the right places.
+	var xref = regexp.MustCompile(`xref\n3 1\n(\d{10}) 00000 n \n`).FindStringSubmatch(update)
+	if xref == nil {
+		t.Fatalf("Should add an xref section, got %q", update)
+	}
+	if offset, _ := strconv.Atoi(xref[1]); offset != len(pdf) {
+		t.Errorf("Wrong offset for the Info dictionary: %d", offset)
+	}
+	var trailer = regexp.MustCompile(`trailer\n<< /Size 4 /Root 1 0 R /Info 3 0 R /Prev (\d+) /ID \[<01> <02>\] >>\n` +
+		`startxref\n(\d+)\n%%EOF\n$`).FindStringSubmatch(update)
+	if trailer == nil {
+		t.Fatalf("Should add a trailer, got %q", update)
+	}
+	if prev, _ := strconv.Atoi(trailer[1]); !bytes.HasPrefix(pdf[prev:], []byte("xref\n")) {
+		t.Error("Should point back at the old xref table")
+	}
+	if start, _ := strconv.Atoi(trailer[2]); !bytes.HasPrefix(updated[start:], []byte("xref\n3 1\n")) {
+		t.Error("Should point startxref at the new xref section")
+	}
+
+	// Just the producer leaves the dates alone.
+	updated, err = setInfo(pdf, time.Time{}, "gotex")
+	if err != nil || !bytes.Contains(updated[len(pdf):], []byte("/CreationDate (D:20240101120000+01'00')")) {
+		t.Errorf("Should keep the dates, got %q, %v", updated[len(pdf):], err)
+	}
+
+	if _, err = setInfo([]byte("%PDF-1.5\n"), time.Time{}, "gotex"); err == nil {
+		t.Error("Should fail on a PDF with no trailer")
+	}
+}
+
+func TestSetInfoXrefStream(t *testing.T) {
+	var pdf = testXrefStreamPDF()
+	var updated, err = setInfo(pdf, time.Time{}, "gotex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(updated, pdf) {
+		t.Fatal("Should only append to the PDF")
+	}
+	var update = string(updated[len(pdf):])
+	if !strings.HasPrefix(update, "3 0 obj\n<< /Title (A \\(tricky\\) >> title)") ||
+		!strings.Contains(update, "/Producer (gotex) >>\nendobj\n") {
+		t.Errorf("Wrong Info dictionary %q", update)
+	}
+
+	// The update is a classic xref section, with /Prev at the xref stream.
+	var xref = regexp.MustCompile(`xref\n3 1\n(\d{10}) 00000 n \n`).FindStringSubmatch(update)
+	if xref == nil {
+		t.Fatalf("Should add an xref section, got %q", update)
+	}
+	if offset, _ := strconv.Atoi(xref[1]); offset != len(pdf) {
+		t.Errorf("Wrong offset for the Info dictionary: %d", offset)
+	}
+	var trailer = regexp.MustCompile(`trailer\n<< /Size 5 /Root 1 0 R /Info 3 0 R /Prev (\d+) /ID \[<01> <02>\] >>\n` +
+		`startxref\n(\d+)\n%%EOF\n$`).FindStringSubmatch(update)
+	if trailer == nil {
+		t.Fatalf("Should add a trailer, got %q", update)
+	}
+	if prev, _ := strconv.Atoi(trailer[1]); !bytes.HasPrefix(pdf[prev:], []byte("4 0 obj\n<< /Type /XRef")) {
+		t.Error("Should point back at the xref stream")
+	}
+	if start, _ := strconv.Atoi(trailer[2]); !bytes.HasPrefix(updated[start:], []byte("xref\n3 1\n")) {
+		t.Error("Should point startxref at the new xref section")
+	}
+}
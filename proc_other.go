@@ -0,0 +1,14 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+//go:build !unix
+
+package gotex
+
+import (
+	"os/exec"
+)
+
+// setCancel leaves cmd to be killed outright when the context is done, since
+// there's no SIGTERM to send.
+func setCancel(cmd *exec.Cmd) {}
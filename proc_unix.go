@@ -0,0 +1,57 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+//go:build unix
+
+package gotex
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// groupPollInterval is how often killGroup checks whether the process group
+// is still there.
+const groupPollInterval = 50 * time.Millisecond
+
+// setCancel puts cmd in a process group of its own, so that anything it starts,
+// such as a shell escape helper, can be stopped along with it. When the
+// context is done, the whole group gets SIGTERM, and then SIGKILL once the
+// grace period is up if any of it is left.
+func setCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		var group = -cmd.Process.Pid
+		var err = syscall.Kill(group, syscall.SIGTERM)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		go killGroup(group)
+		return err
+	}
+}
+
+// killGroup sends SIGKILL to group when the grace period is up, unless the
+// group is gone by then. It keeps checking as it waits, since once every
+// process in the group has exited, its ID is free to be reused by another.
+func killGroup(group int) {
+	var deadline = time.NewTimer(killGracePeriod)
+	defer deadline.Stop()
+	var ticker = time.NewTicker(groupPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-deadline.C:
+			_ = syscall.Kill(group, syscall.SIGKILL)
+			return
+		case <-ticker.C:
+			// Signal 0 only checks that the group exists and is ours.
+			if syscall.Kill(group, 0) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// Project is a document split across several files, such as a book with a
+// file for each chapter.
+type Project struct {
+	// Main is the name of the file LaTeX compiles. It must be one of Files.
+	Main string
+	// Files holds every file in the project, keyed by slash-separated path
+	// relative to the project's root. Main can \include the others by those
+	// paths.
+	Files map[string][]byte
+}
+
+// RenderProject is like Render, but compiles project.Main after writing all of
+// project.Files into the temporary directory. Options.Files are written too,
+// though project.Files win if a name is in both.
+func RenderProject(project Project, options Options) ([]byte, error) {
+	var main, err = cleanFilename(project.Main)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := project.Files[project.Main]; !ok {
+		return nil, fmt.Errorf("gotex: Main %q is not in Files", project.Main)
+	}
+	var files = make(map[string][]byte, len(options.Files)+len(project.Files))
+	for name, contents := range options.Files {
+		files[name] = contents
+	}
+	for name, contents := range project.Files {
+		files[name] = contents
+	}
+	options.Files = files
+
+	var output bytes.Buffer
+	_, err = renderSource(context.Background(), &source{file: main}, options, copyTo(&output))
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
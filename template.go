@@ -0,0 +1,36 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"strings"
+	"text/template"
+)
+
+// The delimiters RenderTemplate uses for actions. Go's usual {{ and }} are
+// everywhere in LaTeX.
+const (
+	TemplateLeftDelim  = "<<"
+	TemplateRightDelim = ">>"
+)
+
+// RenderTemplate fills in the text/template tmpl with data and renders the
+// result like Render. Actions are written as << .Field >> rather than with
+// braces, and the function "escape" runs EscapeString, so text from data can
+// be made safe with << .Name | escape >>. Nothing is escaped unless asked,
+// since data can hold LaTeX too.
+func RenderTemplate(tmpl string, data interface{}, options Options) ([]byte, error) {
+	var t, err = template.New("gotex").
+		Delims(TemplateLeftDelim, TemplateRightDelim).
+		Funcs(template.FuncMap{"escape": EscapeString}).
+		Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	var document strings.Builder
+	if err = t.Execute(&document, data); err != nil {
+		return nil, err
+	}
+	return Render(document.String(), options)
+}
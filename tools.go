@@ -0,0 +1,142 @@
+// Copyright (c) 2017, Randy Westlund. All rights reserved.
+// This code is under the BSD-2-Clause license.
+
+package gotex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// bibEngine returns the bibliography tool that should run on the output of
+// the last LaTeX pass, or "" if there's nothing for one to do.
+func bibEngine(options Options, dir string) string {
+	switch options.BibEngine {
+	case "bibtex":
+		if needsBibtex(options, dir) {
+			return "bibtex"
+		}
+	case "biber":
+		if needsBiber(options, dir) {
+			return "biber"
+		}
+	case "auto":
+		// biblatex also writes \citation lines, so check for it first.
+		if needsBiber(options, dir) {
+			return "biber"
+		}
+		if needsBibtex(options, dir) {
+			return "bibtex"
+		}
+	}
+	return ""
+}
+
+// needsBibtex reports whether the aux file shows that the document both cites
+// something and asks for a bibliography. BibTeX fails if either is missing.
+func needsBibtex(options Options, dir string) bool {
+	var aux, err = ioutil.ReadFile(path.Join(dir, options.Jobname+".aux"))
+	if err != nil {
+		return false
+	}
+	return bytes.Contains(aux, []byte(`\citation{`)) &&
+		bytes.Contains(aux, []byte(`\bibdata{`))
+}
+
+// needsBiber reports whether biblatex has written its control file, which it
+// does whenever it wants biber to run.
+func needsBiber(options Options, dir string) bool {
+	var _, err = os.Stat(path.Join(dir, options.Jobname+".bcf"))
+	return err == nil
+}
+
+// runBib runs the given bibliography engine on the jobname in dir and returns
+// its log. Both BibTeX and biber write their log to a .blg file.
+func runBib(ctx context.Context, options Options, dir, engine string) ([]byte, error) {
+	var command = options.BibCommand
+	if command == "" {
+		command = engine
+	}
+	var logFile = path.Join(dir, options.Jobname+".blg")
+	var err = runTool(ctx, options, dir, logFile, command, options.Jobname)
+	var toolErr *ToolError
+	// BibTeX exits with 1 when there were only warnings, such as a missing
+	// entry. Those show up as "[?]" in the document, not as a failure.
+	if engine == "bibtex" && errors.As(err, &toolErr) && toolErr.ExitCode == 1 {
+		err = nil
+	}
+	return readLog(logFile), err
+}
+
+// indexChanged reports whether LaTeX has written an .idx file that differs from
+// last, which is the one makeindex last ran on or nil. It also returns the
+// new contents.
+func indexChanged(options Options, dir string, last []byte) ([]byte, bool) {
+	var idx, err = ioutil.ReadFile(path.Join(dir, options.Jobname+".idx"))
+	if err != nil {
+		return nil, false
+	}
+	return idx, last == nil || !bytes.Equal(idx, last)
+}
+
+// runMakeIndex turns the .idx file into the .ind file that \printindex reads.
+func runMakeIndex(ctx context.Context, options Options, dir string) error {
+	var args = append(append([]string{}, options.MakeIndexArgs...), options.Jobname+".idx")
+	return runTool(ctx, options, dir, path.Join(dir, options.Jobname+".ilg"),
+		options.MakeIndexCommand, args...)
+}
+
+// glossariesChanged is like indexChanged, for the .glo and .acn files that the
+// glossaries package writes for its main glossary and list of acronyms.
+func glossariesChanged(options Options, dir string, last []byte) ([]byte, bool) {
+	var glo []byte
+	var found bool
+	for _, ext := range []string{".glo", ".acn"} {
+		var contents, err = ioutil.ReadFile(path.Join(dir, options.Jobname+ext))
+		if err != nil {
+			continue
+		}
+		found = true
+		glo = append(append(glo, contents...), 0)
+	}
+	if !found {
+		return nil, false
+	}
+	return glo, last == nil || !bytes.Equal(glo, last)
+}
+
+// runMakeGlossaries turns the glossary files into the ones \printglossaries
+// reads. makeglossaries finds the glossaries to sort in the aux file.
+func runMakeGlossaries(ctx context.Context, options Options, dir string) error {
+	return runTool(ctx, options, dir, path.Join(dir, options.Jobname+".glg"),
+		options.GlossariesCommand, options.Jobname)
+}
+
+// runTool runs one of the helper programs, such as BibTeX, in dir. logFile is
+// the path of the log file the tool writes, if any.
+func runTool(ctx context.Context, options Options, dir, logFile, command string, args ...string) error {
+	var cmd = newCommand(ctx, options, dir, command, args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	var err = cmd.Run()
+	if err != nil {
+		var toolErr = &ToolError{
+			Tool:     command,
+			Dir:      dir,
+			ExitCode: exitCode(err),
+			Output:   output.Bytes(),
+			Err:      commandNotFound(err),
+		}
+		if logFile != "" {
+			toolErr.LogFile = logFile
+			toolErr.Log = readLog(logFile)
+		}
+		return toolErr
+	}
+	return nil
+}